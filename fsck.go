@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"submesh/submesh/feeds"
+	"submesh/submesh/fileencoding"
+	"submesh/submesh/filelog"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/spf13/viper"
+)
+
+const fsckUsage = `usage: submesh fsck [-n] [file log...]
+
+Checks file logs for damaged entries, like a write torn by a crash, and writes a
+repaired copy next to each damaged one: log.cbor becomes log.repaired.cbor.
+Without any files it checks every feed's file log and their rotated backups,
+reading config.yaml if there is one.
+Exits 1 if anything was damaged and 2 on errors.
+`
+
+// repairedName is where the repaired copy of filename goes; gzipped logs stay gzipped
+func repairedName(filename string) string {
+	compressed := strings.HasSuffix(filename, ".gz")
+	name := strings.TrimSuffix(filename, ".gz")
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext) + ".repaired" + ext
+	if compressed {
+		name += ".gz"
+	}
+	return name
+}
+
+type fsckResult struct {
+	entries        int
+	skippedBytes   int64
+	skippedRecords int
+}
+
+// scanLog reads filename through the resynchronizing reader, calling fn for every entry it keeps
+func scanLog(filename string, fn func(entry *fileencoding.LogEntry) error) (fsckResult, error) {
+	var result fsckResult
+	in, err := filelog.Open(filename)
+	if err != nil {
+		return result, err
+	}
+	defer in.Close()
+	reader := fileencoding.NewReader(in)
+	for {
+		var entry fileencoding.LogEntry
+		err := reader.Next(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		result.entries++
+		if err := fn(&entry); err != nil {
+			return result, err
+		}
+	}
+	result.skippedBytes = reader.SkippedBytes
+	result.skippedRecords = reader.SkippedRecords
+	return result, nil
+}
+
+// fsckFile checks filename and, unless checkOnly, copies the entries it kept to out if any were damaged.
+// Damage is rare, so the copy is a second pass rather than holding the whole log in memory
+func fsckFile(filename string, out string, checkOnly bool) (fsckResult, error) {
+	result, err := scanLog(filename, func(*fileencoding.LogEntry) error { return nil })
+	if err != nil || checkOnly || result.skippedRecords == 0 {
+		return result, err
+	}
+	w, err := createLog(out)
+	if err != nil {
+		return result, err
+	}
+	if _, err := scanLog(filename, w.Write); err != nil {
+		w.file.Close()
+		return result, err
+	}
+	if err := w.Close(); err != nil {
+		return result, err
+	}
+	// the damaged file's index doesn't line up with the copy
+	return result, filelog.BuildIndex(out)
+}
+
+// logWriter encodes entries the way the file log writes them
+type logWriter struct {
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+	enc  *cbor.Encoder
+}
+
+// createLog starts a log at filename, gzipped if the name ends in .gz
+func createLog(filename string) (*logWriter, error) {
+	em, err := cbor.CoreDetEncOptions().EncMode()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &logWriter{file: file}
+	var dst io.Writer = file
+	if strings.HasSuffix(filename, ".gz") {
+		w.gz = gzip.NewWriter(file)
+		dst = w.gz
+	}
+	w.buf = bufio.NewWriter(dst)
+	w.enc = em.NewEncoder(w.buf)
+	return w, nil
+}
+
+func (w *logWriter) Write(entry *fileencoding.LogEntry) error {
+	return w.enc.Encode(entry)
+}
+
+func (w *logWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+// configuredLogs is every feed's file log with its backups, oldest first, by config.yaml or the defaults without one
+func configuredLogs() ([]string, error) {
+	if err := readConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, err
+		}
+	}
+	configs, err := feeds.ConfigsFromViper()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, cfg := range configs {
+		logName := feedFile(rawLogName(), cfg.Name, len(configs) == 1)
+		backups, err := filelog.Backups(logName)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range backups {
+			files = append(files, b.Filename)
+		}
+		files = append(files, logName)
+	}
+	return files, nil
+}
+
+// fsck is the fsck command; it returns the exit code
+func fsck(args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), fsckUsage) }
+	checkOnly := flags.Bool("n", false, "only check, don't write repaired copies")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	files := flags.Args()
+	if len(files) == 0 {
+		var err error
+		if files, err = configuredLogs(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	code := 0
+	for _, filename := range files {
+		out := repairedName(filename)
+		result, err := fsckFile(filename, out, *checkOnly)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			code = 2
+			continue
+		}
+		status := "ok"
+		if result.skippedRecords > 0 {
+			code = max(code, 1)
+			status = fmt.Sprintf("skipped %d bytes in %d damaged stretches", result.skippedBytes, result.skippedRecords)
+			if !*checkOnly {
+				status += ", repaired copy in " + out
+			}
+		}
+		fmt.Printf("%s: %d entries, %s\n", filename, result.entries, status)
+	}
+	return code
+}
@@ -3,17 +3,29 @@ package main
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"submesh/submesh/alerts"
+	"submesh/submesh/boltstore"
 	"submesh/submesh/catchup"
 	"submesh/submesh/contextkeys"
+	"submesh/submesh/downlink"
+	"submesh/submesh/feeds"
 	"submesh/submesh/filelog"
+	"submesh/submesh/hub"
+	"submesh/submesh/keyring"
+	"submesh/submesh/mbtiles"
+	"submesh/submesh/metrics"
 	"submesh/submesh/mqtt"
-	"submesh/submesh/parser"
+	"submesh/submesh/republish"
+	"submesh/submesh/search"
 	"submesh/submesh/state"
 	"submesh/submesh/web"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -22,32 +34,82 @@ import (
 const AppVersion = "0.0.9"
 
 func doConfig() {
-	// LoadConfig
+	if err := readConfig(); err != nil {
+		panic(fmt.Errorf("fatal error config file: %w", err))
+	}
+}
+
+// readConfig sets the defaults and reads the config file over them
+func readConfig() error {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath("/etc/submesh/")
 	viper.AddConfigPath("$HOME/.submesh")
 	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
-	if err != nil {
-		panic(fmt.Errorf("fatal error config file: %w", err))
-	}
 
+	viper.SetDefault("web.host", "")
 	viper.SetDefault("web.port", 8080)
+	viper.SetDefault("web.metrics", true)
+	viper.SetDefault("web.map.mbtiles", "")
+	viper.SetDefault("web.map.online", "https://tile.openstreetmap.org/{z}/{x}/{y}.png")
+	viper.SetDefault("web.map.attribution", `&copy; <a href="http://www.openstreetmap.org/copyright">OpenStreetMap</a>`)
+	viper.SetDefault("web.map.online_fallback", false)
+	viper.SetDefault("web.topology.half_life", "6h")
+	viper.SetDefault("web.topology.max_age", "72h")
+	viper.SetDefault("web.api.max_limit", 5000)
+	viper.SetDefault("web.replay.max_window", "24h")
+	viper.SetDefault("web.replay.max_entries", 200000)
 	viper.SetDefault("mqtt.host", "localhost")
-	viper.SetDefault("mqtt.port", 1883)
 	viper.SetDefault("mqtt.username", "")
 	viper.SetDefault("mqtt.password", "")
 	viper.SetDefault("mqtt.topics", []string{})
+	viper.SetDefault("mqtt.dedup_window", "1m")
+	viper.SetDefault("mqtt.republish.enabled", false)
+	viper.SetDefault("mqtt.republish.topic", republish.DefaultTopic)
+	viper.SetDefault("mqtt.republish.qos", 0)
+	viper.SetDefault("mqtt.republish.retain", false)
+	viper.SetDefault("mqtt.republish.queue", republish.DefaultQueue)
+
+	viper.SetDefault("alerts.cooldown", "30m")
+	viper.SetDefault("alerts.interval", "1m")
+	viper.SetDefault("alerts.history", 500)
+
+	viper.SetDefault("downlink.enabled", false)
+	viper.SetDefault("downlink.node_id", "")
+	viper.SetDefault("downlink.topic", downlink.DefaultTopic)
+	viper.SetDefault("downlink.hop_limit", 3)
+	viper.SetDefault("downlink.token", "")
+
 	viper.SetDefault("submesh.production", false)
 	viper.SetDefault("submesh.all_limit", 500)
 
+	viper.SetDefault("submesh.dedup.enabled", true)
+	viper.SetDefault("submesh.dedup.ttl", "30m")
+	viper.SetDefault("submesh.dedup.sweep_interval", "1m")
+	viper.SetDefault("submesh.dedup.catchup", true)
+
+	viper.SetDefault("submesh.store.type", "memory")
+	viper.SetDefault("submesh.store.path", "submesh.db")
+
+	viper.SetDefault("submesh.search.limit", 50000)
+
 	viper.SetDefault("submesh.db.max_megs", 50)
 	viper.SetDefault("submesh.db.max_backups", 28)
 	viper.SetDefault("submesh.db.max_age", 28)
+	viper.SetDefault("submesh.catchup.max_age", "0")
+	viper.SetDefault("submesh.catchup.since", "")
+	viper.SetDefault("submesh.catchup.workers", 0)
+	viper.SetDefault("submesh.catchup.progress_interval", "10s")
+	viper.SetDefault("submesh.snapshot.interval", "10m")
+	viper.SetDefault("submesh.snapshot.path", "snapshot.cbor")
+	return viper.ReadInConfig()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(fsck(os.Args[2:]))
+	}
+
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
@@ -63,27 +125,102 @@ func main() {
 	logger, _ := config.Build()
 
 	defer logger.Sync()
-	b64log := "log.cbor"
 
 	if viper.GetBool("submesh.production") {
 		logger.Info("running in production mode")
-		b64log = "log_prod.cbor"
 	}
-	filelogger := filelog.NewFileLog(b64log)
-	defer filelogger.Close()
 
 	// setup context
-	ctx = context.WithValue(ctx, contextkeys.RAWFileLogger, filelogger)
 	ctx = context.WithValue(ctx, contextkeys.Logger, logger)
-	ctx = context.WithValue(ctx, contextkeys.State, state.NewState())
 	ctx = context.WithValue(ctx, contextkeys.AtomicLevel, &atomicLevel)
 	ctx = context.WithValue(ctx, contextkeys.AppVersion, AppVersion)
+	ctx = context.WithValue(ctx, contextkeys.Metrics, metrics.New())
+
+	if viper.GetDuration("submesh.dedup.sweep_interval") <= 0 {
+		logger.Fatal("submesh.dedup.sweep_interval must be positive", zap.String("sweep_interval", viper.GetString("submesh.dedup.sweep_interval")))
+	}
+
+	configs, err := feeds.ConfigsFromViper()
+	if err != nil {
+		logger.Fatal("error loading feeds", zap.Error(err))
+	}
+	globalKeys, err := keyring.NewKeyringFromConfig()
+	if err != nil {
+		logger.Fatal("error loading channel keys", zap.Error(err))
+	}
+
+	// a lone feed keeps the historical file names
+	single := len(configs) == 1
+	list := []*feeds.Feed{}
+	rings := []*keyring.Keyring{}
+	logNames := []string{}
+	for _, cfg := range configs {
+		keys, err := cfg.Keyring(globalKeys)
+		if err != nil {
+			logger.Fatal("error loading channel keys", zap.String("feed", cfg.Name), zap.Error(err))
+		}
+		logName := feedFile(rawLogName(), cfg.Name, single)
+		feed, closeFeed := newFeed(ctx, cfg.Name, cfg.Topics, keys, logName, feedFile(viper.GetString("submesh.store.path"), cfg.Name, single), feedFile(viper.GetString("submesh.snapshot.path"), cfg.Name, single))
+		defer closeFeed()
+		list = append(list, feed)
+		rings = append(rings, keys)
+		logNames = append(logNames, logName)
+	}
+
+	var merged *feeds.Feed
+	if !single {
+		var closeMerged func()
+		merged, closeMerged = newFeed(ctx, feeds.MergedName, nil, keyring.Merge(rings...), "", feedFile(viper.GetString("submesh.store.path"), feeds.MergedName, false), feedFile(viper.GetString("submesh.snapshot.path"), feeds.MergedName, false))
+		defer closeMerged()
+	}
+	all := feeds.NewFeeds(list, merged)
+
+	// names and last heard in the web ui come from the default feed
+	ctx = context.WithValue(ctx, contextkeys.State, all.Default().State)
+	ctx = context.WithValue(ctx, contextkeys.Feeds, all)
 
 	// catch up
-	catchup.CatchUp(ctx)
+	replays := []catchup.Replay{}
+	for i, feed := range list {
+		targets := []context.Context{feed.Ctx}
+		if merged != nil {
+			targets = append(targets, merged.Ctx)
+		}
+		replays = append(replays, catchup.Replay{Filename: logNames[i], Targets: targets})
+	}
+	catchup.CatchUpAll(ctx, replays)
+
+	for _, feed := range list {
+		go feed.State.Dedup.StartSweeper(ctx, viper.GetDuration("submesh.dedup.sweep_interval"))
+	}
+	if merged != nil {
+		go merged.State.Dedup.StartSweeper(ctx, viper.GetDuration("submesh.dedup.sweep_interval"))
+	}
 
 	// subscribe to mqtt
-	go doMqtt(ctx)
+	statuses, router := connectBrokers(ctx, configs, list, merged)
+	ctx = context.WithValue(ctx, contextkeys.Brokers, statuses)
+
+	if viper.GetBool("mqtt.republish.enabled") {
+		startRepublisher(ctx, statuses, all.Default())
+	}
+
+	if viper.IsSet("alerts.rules") {
+		ctx = context.WithValue(ctx, contextkeys.Alerts, startAlerts(ctx, statuses, all.Default()))
+	}
+
+	if viper.GetBool("downlink.enabled") {
+		ctx = context.WithValue(ctx, contextkeys.Downlink, newSender(ctx, statuses, router))
+	}
+
+	if path := viper.GetString("web.map.mbtiles"); path != "" {
+		tiles, err := mbtiles.Open(path)
+		if err != nil {
+			logger.Fatal("error opening map tiles", zap.Error(err))
+		}
+		logger.Info("serving map tiles", zap.String("path", path), zap.String("format", tiles.Format), zap.Int("min_zoom", tiles.MinZoom), zap.Int("max_zoom", tiles.MaxZoom))
+		ctx = context.WithValue(ctx, contextkeys.Tiles, tiles)
+	}
 
 	// start webserver
 	go web.StartServer(ctx)
@@ -93,18 +230,298 @@ func main() {
 	logger.Warn("signal caught, exiting")
 }
 
-func doMqtt(ctx context.Context) {
-	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
+func rawLogName() string {
+	if viper.GetBool("submesh.production") {
+		return "log_prod.cbor"
+	}
+	return "log.cbor"
+}
+
+// feedFile suffixes a file name with the feed, unless it is the only one
+func feedFile(base string, name string, single bool) string {
+	if single {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return fmt.Sprintf("%s_%s%s", strings.TrimSuffix(base, ext), name, ext)
+}
+
+// newFeed sets up a feed's state, store or snapshots, keys, hub and search index; logName is empty for the merged feed
+func newFeed(ctx context.Context, name string, topics []string, keys *keyring.Keyring, logName string, storePath string, snapshotPath string) (*feeds.Feed, func()) {
+	logger := ctx.Value(contextkeys.Logger).(*zap.Logger).With(zap.String("feed", name))
+	closers := []func(){}
+
+	if logName != "" {
+		filelogger := filelog.NewFileLog(logName)
+		closers = append(closers, filelogger.Close)
+		ctx = context.WithValue(ctx, contextkeys.RAWFileLogger, filelogger)
+	}
+	logger.Info("loaded keys", zap.Int("channels", len(keys.Channels())), zap.Int("nodes", keys.Nodes()))
+
+	newState := func() *state.State {
+		st := state.NewState()
+		st.Dedup.Enabled = viper.GetBool("submesh.dedup.enabled")
+		st.Dedup.TTL = viper.GetDuration("submesh.dedup.ttl")
+		st.Dedup.DuringCatchup = viper.GetBool("submesh.dedup.catchup")
+		return st
+	}
+	st := newState()
 
-	u, err := url.Parse(fmt.Sprintf("mqtt://%s:%d", viper.GetString("mqtt.host"), viper.GetInt("mqtt.port")))
-	if viper.GetString("mqtt.username") != "" {
-		u.User = url.UserPassword(viper.GetString("mqtt.username"), viper.GetString("mqtt.password"))
+	switch viper.GetString("submesh.store.type") {
+	case "bolt":
+		store, err := boltstore.NewBoltStore(storePath, logger)
+		if err != nil {
+			logger.Fatal("error opening store", zap.Error(err))
+		}
+		closers = append(closers, func() { store.Close() })
+		if err := st.Persist(store, logger); err != nil {
+			logger.Fatal("error loading store", zap.Error(err))
+		}
+		logger.Info("using bolt store", zap.String("path", storePath), zap.Time("high_water", st.HighWater()))
+	case "memory":
+		// the bolt store keeps everything already, snapshots spare the memory store a full replay
+		if interval := viper.GetDuration("submesh.snapshot.interval"); interval > 0 {
+			if err := st.RestoreSnapshot(snapshotPath); err == nil {
+				logger.Info("restored snapshot", zap.String("path", snapshotPath), zap.Time("high_water", st.HighWater()))
+			} else if !os.IsNotExist(err) {
+				logger.Warn("error restoring snapshot, replaying the whole file log", zap.String("path", snapshotPath), zap.Error(err))
+				st = newState()
+			}
+			go writeSnapshots(ctx, logger, st, snapshotPath, interval)
+			closers = append(closers, func() { writeSnapshot(logger, st, snapshotPath) })
+		}
+	default:
+		logger.Fatal("unknown store type", zap.String("type", viper.GetString("submesh.store.type")))
 	}
+
+	index := search.NewIndex()
+	index.Limit = viper.GetInt("submesh.search.limit")
+	// a store restores state that catchup won't replay
+	index.Seed(st)
+
+	ctx = context.WithValue(ctx, contextkeys.State, st)
+	ctx = context.WithValue(ctx, contextkeys.Keyring, keys)
+	ctx = context.WithValue(ctx, contextkeys.Hub, hub.NewHub())
+	ctx = context.WithValue(ctx, contextkeys.Search, index)
+	ctx = context.WithValue(ctx, contextkeys.FeedMetrics, ctx.Value(contextkeys.Metrics).(*metrics.Metrics).Feed(name, st))
+
+	feed := &feeds.Feed{
+		Name:   name,
+		Topics: topics,
+		Ctx:    ctx,
+		State:  st,
+	}
+	return feed, func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+}
+
+// writeSnapshots saves st every interval, skipping intervals where nothing new was handled
+func writeSnapshots(ctx context.Context, logger *zap.Logger, st *state.State, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var written time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if hw := st.HighWater(); !hw.After(written) {
+				continue
+			}
+			written = writeSnapshot(logger, st, path)
+		}
+	}
+}
+
+// writeSnapshot saves st to path and returns the high-water mark it was saved at
+func writeSnapshot(logger *zap.Logger, st *state.State, path string) time.Time {
+	start := time.Now()
+	hw, err := st.WriteSnapshot(path)
+	if err != nil {
+		logger.Error("error writing snapshot", zap.String("path", path), zap.Error(err))
+		return time.Time{}
+	}
+	logger.Info("wrote snapshot", zap.String("path", path), zap.Time("high_water", hw), zap.Duration("took", time.Since(start)))
+	return hw
+}
+
+// connectBrokers attaches each feed to its brokers and connects to every broker something listens to
+func connectBrokers(ctx context.Context, configs []feeds.Config, list []*feeds.Feed, merged *feeds.Feed) ([]*mqtt.Status, *feeds.Router) {
+	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
+
+	brokers, err := mqtt.BrokersFromViper()
 	if err != nil {
-		panic(err)
+		logger.Fatal("error loading brokers", zap.Error(err))
+	}
+	shared := []string{}
+	known := map[string]bool{}
+	for _, b := range brokers {
+		shared = append(shared, b.Name)
+		known[b.Name] = true
 	}
 
-	topics := viper.GetStringSlice("mqtt.topics")
-	logger.Info("subscribing to topics", zap.Strings("topics", topics))
-	mqtt.MQTTConnectAndListen(ctx, topics, u, parser.HandleMQTTMessage)
+	router := feeds.NewRouter(merged, viper.GetDuration("mqtt.dedup_window"))
+	for i, cfg := range configs {
+		names := cfg.Brokers
+		if private := cfg.Broker(); private != nil {
+			if known[private.Name] {
+				logger.Fatal("feed broker clashes with a broker name", zap.String("feed", cfg.Name))
+			}
+			brokers = append(brokers, *private)
+			known[private.Name] = true
+			names = append(names, private.Name)
+		} else if len(names) == 0 {
+			names = shared
+		}
+		for _, name := range names {
+			if !known[name] {
+				logger.Fatal("feed uses an unknown broker", zap.String("feed", cfg.Name), zap.String("broker", name))
+			}
+			router.Attach(name, list[i])
+		}
+	}
+
+	statuses := []*mqtt.Status{}
+	for _, broker := range brokers {
+		attached := router.Attached(broker.Name)
+		if len(attached) == 0 {
+			logger.Warn("no feed uses broker, not connecting", zap.String("broker", broker.Name))
+			continue
+		}
+		// without topics of its own a broker serves its feeds' topics
+		if len(broker.Topics) == 0 {
+			seen := map[string]bool{}
+			for _, feed := range attached {
+				for _, topic := range feed.Topics {
+					if !seen[topic] {
+						broker.Topics = append(broker.Topics, topic)
+						seen[topic] = true
+					}
+				}
+			}
+		}
+		status := mqtt.NewStatus(broker)
+		statuses = append(statuses, status)
+		ctx.Value(contextkeys.Metrics).(*metrics.Metrics).Broker(status)
+		logger.Info("subscribing to topics", zap.String("broker", broker.Name), zap.Strings("topics", broker.Topics))
+		go mqtt.MQTTConnectAndListen(ctx, broker, status, router.Handler(broker.Name, status))
+	}
+	return statuses, router
+}
+
+// findBroker is the connected broker by name, or the first one when name is empty
+func findBroker(statuses []*mqtt.Status, name string) *mqtt.Status {
+	for _, status := range statuses {
+		if name == "" || status.Snapshot().Name == name {
+			return status
+		}
+	}
+	return nil
+}
+
+// startRepublisher publishes the default feed's decoded packets to mqtt.republish.broker, or the first broker
+func startRepublisher(ctx context.Context, statuses []*mqtt.Status, feed *feeds.Feed) {
+	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
+	broker := findBroker(statuses, viper.GetString("mqtt.republish.broker"))
+	if broker == nil {
+		logger.Fatal("no broker to republish to", zap.String("broker", viper.GetString("mqtt.republish.broker")))
+	}
+	republisher := republish.NewRepublisher(broker, viper.GetString("mqtt.republish.topic"))
+	qos := viper.GetUint("mqtt.republish.qos")
+	if qos > 2 {
+		logger.Fatal("mqtt.republish.qos must be 0, 1 or 2", zap.Uint("qos", qos))
+	}
+	republisher.QoS = byte(qos)
+	republisher.Retain = viper.GetBool("mqtt.republish.retain")
+	republisher.Queue = viper.GetInt("mqtt.republish.queue")
+	if republisher.Queue <= 0 {
+		logger.Fatal("mqtt.republish.queue must be positive", zap.Int("queue", republisher.Queue))
+	}
+	ctx.Value(contextkeys.Metrics).(*metrics.Metrics).Republish(republisher.Dropped)
+	logger.Info("republishing decoded packets", zap.String("broker", broker.Snapshot().Name), zap.String("topic", republisher.Template))
+	go republisher.Run(ctx, feed.Ctx.Value(contextkeys.Hub).(*hub.Hub))
+}
+
+// newSender sends as downlink.node_id through downlink.broker, or the first broker
+func newSender(ctx context.Context, statuses []*mqtt.Status, router *feeds.Router) *downlink.Sender {
+	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
+	broker := findBroker(statuses, viper.GetString("downlink.broker"))
+	if broker == nil {
+		logger.Fatal("no broker to send through", zap.String("broker", viper.GetString("downlink.broker")))
+	}
+	// without a token anyone who can reach the web ui could send as our node
+	if viper.GetString("downlink.token") == "" && !loopbackOnly(viper.GetString("web.host")) {
+		logger.Fatal("downlink.token is required unless web.host is a loopback address like 127.0.0.1", zap.String("host", viper.GetString("web.host")))
+	}
+	nodeId, err := keyring.ParseNodeId(viper.GetString("downlink.node_id"))
+	if err != nil || nodeId == 0 || nodeId == downlink.Broadcast {
+		logger.Fatal("downlink.node_id must be a node id like !a1b2c3d4", zap.String("node_id", viper.GetString("downlink.node_id")))
+	}
+	name := broker.Snapshot().Name
+	sender := downlink.NewSender(broker, nodeId, func(topic string, payload []byte) {
+		router.Inject(name, topic, payload)
+	})
+	sender.Topic = viper.GetString("downlink.topic")
+	sender.HopLimit = viper.GetUint32("downlink.hop_limit")
+	if sender.HopLimit > 7 {
+		logger.Fatal("downlink.hop_limit can be at most 7", zap.Uint32("hop_limit", sender.HopLimit))
+	}
+	logger.Info("downlink enabled", zap.String("broker", name), zap.String("node_id", viper.GetString("downlink.node_id")), zap.String("topic", sender.Topic))
+	return sender
+}
+
+// loopbackOnly is whether listening on host only accepts connections from this machine
+func loopbackOnly(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// startAlerts runs the configured rules against the default feed and hands alerts to every configured sink
+func startAlerts(ctx context.Context, statuses []*mqtt.Status, feed *feeds.Feed) *alerts.Engine {
+	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
+	var rules []alerts.Rule
+	if err := viper.UnmarshalKey("alerts.rules", &rules); err != nil {
+		logger.Fatal("error loading alert rules", zap.Error(err))
+	}
+
+	sinks := []alerts.Sink{}
+	var file *alerts.FileSink
+	if name := viper.GetString("alerts.file"); name != "" {
+		file = alerts.NewFileSink(name)
+		sinks = append(sinks, file)
+	}
+	if url := viper.GetString("alerts.webhook"); url != "" {
+		sinks = append(sinks, alerts.NewWebhookSink(url))
+	}
+	if topic := viper.GetString("alerts.mqtt.topic"); topic != "" {
+		broker := findBroker(statuses, viper.GetString("alerts.mqtt.broker"))
+		if broker == nil {
+			logger.Fatal("no broker to send alerts to", zap.String("broker", viper.GetString("alerts.mqtt.broker")))
+		}
+		sinks = append(sinks, alerts.NewMQTTSink(broker, topic))
+	}
+
+	engine, err := alerts.NewEngine(feed.State, rules, sinks)
+	if err != nil {
+		logger.Fatal("error loading alert rules", zap.Error(err))
+	}
+	engine.Cooldown = viper.GetDuration("alerts.cooldown")
+	engine.Interval = viper.GetDuration("alerts.interval")
+	engine.HistoryLimit = viper.GetInt("alerts.history")
+	if file != nil {
+		previous, err := file.Load(engine.HistoryLimit)
+		if err != nil {
+			logger.Warn("error reading previous alerts", zap.Error(err))
+		}
+		engine.Restore(previous)
+	}
+	logger.Info("alerting", zap.Int("rules", len(rules)), zap.Int("sinks", len(sinks)))
+	go engine.Run(ctx, feed.Ctx.Value(contextkeys.Hub).(*hub.Hub))
+	return engine
 }
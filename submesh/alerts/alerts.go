@@ -0,0 +1,300 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/hub"
+	"submesh/submesh/keyring"
+	"submesh/submesh/state"
+	"submesh/submesh/types"
+	"sync"
+	"time"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const defaultHistory = 500
+
+// Alert is one rule firing
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Rule    string    `json:"rule"`
+	Type    string    `json:"type"`
+	Node    uint32    `json:"node"`
+	NodeHex string    `json:"node_hex"`
+	Message string    `json:"message"`
+}
+
+// Engine evaluates the rules against live packets and on a timer
+type Engine struct {
+	// Cooldown is how long the same rule stays quiet about the same subject
+	Cooldown time.Duration
+	// Interval is how often node_silent is checked
+	Interval time.Duration
+	// HistoryLimit is how many alerts /alerts keeps
+	HistoryLimit int
+	rules        []Rule
+	sinks        []Sink
+	state        *state.State
+	queue        chan Alert
+
+	lock      sync.Mutex
+	heard     map[uint32]time.Time
+	silent    map[string]bool
+	lastFired map[string]time.Time
+	history   []Alert
+	started   time.Time
+}
+
+func NewEngine(st *state.State, rules []Rule, sinks []Sink) (*Engine, error) {
+	for i := range rules {
+		if err := rules[i].check(); err != nil {
+			return nil, err
+		}
+	}
+	return &Engine{
+		Cooldown:     30 * time.Minute,
+		Interval:     time.Minute,
+		HistoryLimit: defaultHistory,
+		rules:        rules,
+		sinks:        sinks,
+		state:        st,
+		queue:        make(chan Alert, 64),
+		heard:        map[uint32]time.Time{},
+		silent:       map[string]bool{},
+		lastFired:    map[string]time.Time{},
+	}, nil
+}
+
+// Restore puts alerts from a previous run back into the history
+func (e *Engine) Restore(previous []Alert) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.history = append(previous, e.history...)
+	e.trim()
+}
+
+func (e *Engine) trim() {
+	if len(e.history) > e.HistoryLimit {
+		e.history = e.history[len(e.history)-e.HistoryLimit:]
+	}
+}
+
+// History is the newest alerts first
+func (e *Engine) History() []Alert {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	out := make([]Alert, 0, len(e.history))
+	for i := len(e.history) - 1; i >= 0; i-- {
+		out = append(out, e.history[i])
+	}
+	return out
+}
+
+func (e *Engine) Rules() []Rule {
+	return e.rules
+}
+
+// seed learns which nodes the state already knows, so a restart doesn't announce them all as new
+func (e *Engine) seed() {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.started = time.Now()
+	for _, m := range e.state.AllMessages.All() {
+		at := time.Unix(int64(m.RxTime), 0)
+		if at.After(e.heard[m.From]) {
+			e.heard[m.From] = at
+		}
+	}
+	users := e.state.Users.All()
+	for i := range users {
+		u := &users[i]
+		if _, ok := e.heard[u.From]; !ok {
+			e.heard[u.From] = time.Unix(int64(u.RxTime), 0)
+		}
+	}
+}
+
+func (e *Engine) nodeName(node uint32) string {
+	if user := e.state.Users.LastBy(fmt.Sprintf("%d", node)); user != nil && user.Underlying.LongName != "" {
+		return fmt.Sprintf("%s (%s)", user.Underlying.LongName, keyring.FormatNodeId(node))
+	}
+	return keyring.FormatNodeId(node)
+}
+
+// fire queues an alert unless the rule already fired for subject within its cooldown; the caller holds the lock
+func (e *Engine) fire(rule *Rule, subject string, node uint32, now time.Time, message string) {
+	key := rule.Name + "/" + subject
+	cooldown := e.Cooldown
+	if rule.Cooldown > 0 {
+		cooldown = rule.Cooldown
+	}
+	if last, ok := e.lastFired[key]; ok && now.Sub(last) < cooldown {
+		return
+	}
+	e.lastFired[key] = now
+	a := Alert{
+		Time:    now,
+		Rule:    rule.Name,
+		Type:    rule.Type,
+		Node:    node,
+		NodeHex: keyring.FormatNodeId(node),
+		Message: message,
+	}
+	e.history = append(e.history, a)
+	e.trim()
+	select {
+	case e.queue <- a:
+	default:
+		// sinks are behind; the history still has it
+	}
+}
+
+// Observe checks one live packet against every rule
+func (e *Engine) Observe(m *types.ParsedMessage[types.MessageSummary], now time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	_, known := e.heard[m.From]
+	e.heard[m.From] = now
+
+	var telemetry *meshtastic.Telemetry
+	var route *meshtastic.RouteDiscovery
+	switch meshtastic.PortNum(m.Underlying.PortNum) {
+	case meshtastic.PortNum_TELEMETRY_APP:
+		telemetry = &meshtastic.Telemetry{}
+		if protojson.Unmarshal([]byte(m.Underlying.Summary), telemetry) != nil {
+			telemetry = nil
+		}
+	case meshtastic.PortNum_TRACEROUTE_APP:
+		route = &meshtastic.RouteDiscovery{}
+		if protojson.Unmarshal([]byte(m.Underlying.Summary), route) != nil {
+			route = nil
+		}
+	}
+
+	for i := range e.rules {
+		rule := &e.rules[i]
+		switch rule.Type {
+		case NewNode:
+			if !known {
+				e.fire(rule, fmt.Sprintf("%d", m.From), m.From, now, fmt.Sprintf("new node %s", e.nodeName(m.From)))
+			}
+		case NodeSilent:
+			// heard again, so the next silence is news
+			delete(e.silent, fmt.Sprintf("%s/%d", rule.Name, m.From))
+		case BatteryLow:
+			dm := telemetry.GetDeviceMetrics()
+			if dm == nil || dm.BatteryLevel == nil || !rule.covers(m.From) {
+				continue
+			}
+			if level := dm.GetBatteryLevel(); float64(level) < rule.Below {
+				e.fire(rule, fmt.Sprintf("%d", m.From), m.From, now, fmt.Sprintf("%s battery at %d%%", e.nodeName(m.From), level))
+			}
+		case Keyword:
+			if m.Underlying.PortNum != uint32(meshtastic.PortNum_TEXT_MESSAGE_APP) || !rule.covers(m.From) || !rule.onChannel(m.ChannelName) {
+				continue
+			}
+			if keyword, ok := rule.matchKeyword(m.Underlying.Summary); ok {
+				e.fire(rule, fmt.Sprintf("%d/%s", m.From, keyword), m.From, now, fmt.Sprintf("%s said %q", e.nodeName(m.From), m.Underlying.Summary))
+			}
+		case TracerouteHop:
+			if route == nil {
+				continue
+			}
+			for _, hop := range append(append([]uint32{}, route.Route...), route.RouteBack...) {
+				if rule.nodes[hop] {
+					e.fire(rule, fmt.Sprintf("%d/%d/%d", m.From, m.To, hop), hop, now,
+						fmt.Sprintf("traceroute from %s to %s went through %s", e.nodeName(m.From), e.nodeName(m.To), e.nodeName(hop)))
+					break
+				}
+			}
+		}
+	}
+}
+
+// Check fires node_silent for every covered node gone quiet
+func (e *Engine) Check(now time.Time) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for i := range e.rules {
+		rule := &e.rules[i]
+		if rule.Type != NodeSilent {
+			continue
+		}
+		limit := time.Duration(rule.Minutes) * time.Minute
+		nodes := rule.nodes
+		if len(nodes) == 0 {
+			// watching everyone only covers nodes heard since startup, not all of history
+			nodes = map[uint32]bool{}
+			for node, at := range e.heard {
+				if !at.Before(e.started) {
+					nodes[node] = true
+				}
+			}
+		}
+		for node := range nodes {
+			last, ok := e.heard[node]
+			if !ok {
+				// never heard: count from startup
+				last = e.started
+			}
+			key := fmt.Sprintf("%s/%d", rule.Name, node)
+			if e.silent[key] || now.Sub(last) < limit {
+				continue
+			}
+			e.silent[key] = true
+			message := fmt.Sprintf("%s not heard for %d minutes", e.nodeName(node), rule.Minutes)
+			if !ok {
+				message = fmt.Sprintf("%s not heard since startup", e.nodeName(node))
+			}
+			e.fire(rule, fmt.Sprintf("%d", node), node, now, message)
+		}
+	}
+}
+
+// Run watches the hub and the clock until ctx is done
+func (e *Engine) Run(ctx context.Context, from *hub.Hub) {
+	log := ctx.Value(contextkeys.Logger).(*zap.Logger).With(zap.String("module", "alerts"))
+	e.seed()
+	go e.deliver(ctx, log)
+
+	sub := from.Subscribe(hub.Filter{})
+	defer sub.Close()
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.Check(now)
+		case m, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			e.Observe(&m, time.Now())
+		}
+	}
+}
+
+func (e *Engine) deliver(ctx context.Context, log *zap.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case a := <-e.queue:
+			log.Info("alert", zap.String("rule", a.Rule), zap.String("message", a.Message))
+			for _, sink := range e.sinks {
+				sendCtx, cancel := context.WithTimeout(ctx, sinkTimeout)
+				if err := sink.Send(sendCtx, a); err != nil {
+					log.Warn("error delivering alert", zap.String("sink", sink.Name()), zap.Error(err))
+				}
+				cancel()
+			}
+		}
+	}
+}
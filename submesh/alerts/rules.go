@@ -0,0 +1,103 @@
+package alerts
+
+import (
+	"fmt"
+	"strings"
+	"submesh/submesh/keyring"
+	"time"
+)
+
+// Rule types
+const (
+	NodeSilent    = "node_silent"
+	BatteryLow    = "battery_low"
+	NewNode       = "new_node"
+	Keyword       = "keyword"
+	TracerouteHop = "traceroute_hop"
+)
+
+// Rule is one entry of alerts.rules; which fields matter depends on Type
+type Rule struct {
+	Name string `mapstructure:"name"`
+	Type string `mapstructure:"type"`
+	// Nodes narrows node_silent, battery_low and keyword to these senders, and is the hops traceroute_hop looks for.
+	// node_silent without nodes watches every node heard since startup
+	Nodes []string `mapstructure:"nodes"`
+	// Minutes is how long a node_silent node can go unheard
+	Minutes int `mapstructure:"minutes"`
+	// Below is the battery_low threshold in percent
+	Below float64 `mapstructure:"below"`
+	// Keywords are matched case-insensitively anywhere in a chat
+	Keywords []string `mapstructure:"keywords"`
+	// Channels narrows keyword to these channel names
+	Channels []string `mapstructure:"channels"`
+	// Cooldown overrides alerts.cooldown for this rule
+	Cooldown time.Duration `mapstructure:"cooldown"`
+
+	nodes map[uint32]bool
+}
+
+// check validates the rule and resolves its node ids
+func (r *Rule) check() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule of type %q needs a name", r.Type)
+	}
+	r.nodes = map[uint32]bool{}
+	for _, s := range r.Nodes {
+		id, err := keyring.ParseNodeId(s)
+		if err != nil {
+			return fmt.Errorf("alert rule %q: invalid node %q", r.Name, s)
+		}
+		r.nodes[id] = true
+	}
+	switch r.Type {
+	case NodeSilent:
+		if r.Minutes <= 0 {
+			return fmt.Errorf("alert rule %q needs minutes", r.Name)
+		}
+	case BatteryLow:
+		if r.Below <= 0 {
+			return fmt.Errorf("alert rule %q needs below", r.Name)
+		}
+	case Keyword:
+		if len(r.Keywords) == 0 {
+			return fmt.Errorf("alert rule %q needs keywords", r.Name)
+		}
+	case TracerouteHop:
+		if len(r.nodes) == 0 {
+			return fmt.Errorf("alert rule %q needs nodes", r.Name)
+		}
+	case NewNode:
+	default:
+		return fmt.Errorf("alert rule %q has unknown type %q", r.Name, r.Type)
+	}
+	return nil
+}
+
+// covers reports whether the rule applies to node; no nodes means all of them
+func (r *Rule) covers(node uint32) bool {
+	return len(r.nodes) == 0 || r.nodes[node]
+}
+
+// matchKeyword returns the first keyword found in text
+func (r *Rule) matchKeyword(text string) (string, bool) {
+	lower := strings.ToLower(text)
+	for _, k := range r.Keywords {
+		if strings.Contains(lower, strings.ToLower(k)) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func (r *Rule) onChannel(name string) bool {
+	if len(r.Channels) == 0 {
+		return true
+	}
+	for _, ch := range r.Channels {
+		if ch == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package alerts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"submesh/submesh/mqtt"
+	"sync"
+	"time"
+)
+
+const sinkTimeout = 10 * time.Second
+
+// Sink is somewhere alerts get delivered
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, a Alert) error
+}
+
+// WebhookSink posts each alert as json
+type WebhookSink struct {
+	URL    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{URL: url, client: &http.Client{Timeout: sinkTimeout}}
+}
+
+func (w *WebhookSink) Name() string { return "webhook" }
+
+func (w *WebhookSink) Send(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// MQTTSink publishes each alert as json to a topic
+type MQTTSink struct {
+	Topic  string
+	broker *mqtt.Status
+}
+
+func NewMQTTSink(broker *mqtt.Status, topic string) *MQTTSink {
+	return &MQTTSink{Topic: topic, broker: broker}
+}
+
+func (m *MQTTSink) Name() string { return "mqtt" }
+
+func (m *MQTTSink) Send(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return m.broker.Publish(ctx, m.Topic, body, 1, false)
+}
+
+// FileSink appends one json line per alert
+type FileSink struct {
+	Filename string
+	lock     sync.Mutex
+}
+
+func NewFileSink(filename string) *FileSink {
+	return &FileSink{Filename: filename}
+}
+
+func (f *FileSink) Name() string { return "file" }
+
+func (f *FileSink) Send(ctx context.Context, a Alert) error {
+	line, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.OpenFile(f.Filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Load reads back the newest limit alerts, oldest first
+func (f *FileSink) Load(limit int) ([]Alert, error) {
+	file, err := os.Open(f.Filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var loaded []Alert
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var a Alert
+		// a torn last line is skipped rather than failing startup
+		if json.Unmarshal(scanner.Bytes(), &a) != nil {
+			continue
+		}
+		loaded = append(loaded, a)
+		if len(loaded) > limit {
+			loaded = loaded[1:]
+		}
+	}
+	return loaded, scanner.Err()
+}
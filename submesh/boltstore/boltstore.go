@@ -0,0 +1,375 @@
+package boltstore
+
+import (
+	"cmp"
+	"encoding/binary"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+const (
+	dataPrefix   = "c:"
+	lastByPrefix = "l:"
+	metaBucket   = "meta"
+	highWaterKey = "highwater"
+
+	flushInterval = 500 * time.Millisecond
+	flushSize     = 1000
+)
+
+type pendingRecord struct {
+	collection string
+	rxTime     uint32
+	record     []byte
+	pks        []string
+}
+
+// BoltStore implements state.Store on top of bbolt.
+// Appends are buffered and committed in batches so catchup isn't bound by fsync; reads see the buffer too.
+type BoltStore struct {
+	db     *bolt.DB
+	logger *zap.Logger
+	lock   sync.Mutex
+	// commit is held for writing while a batch is committed
+	commit    sync.RWMutex
+	pending   []pendingRecord
+	highWater time.Time
+	dirty     bool
+	flushNow  chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewBoltStore(path string, logger *zap.Logger) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b := &BoltStore{
+		db:       db,
+		logger:   logger,
+		flushNow: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.flusher()
+	return b, nil
+}
+
+// recordKey sorts records by receive time, with a sequence number to keep them unique
+func recordKey(rxTime uint32, seq uint64) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key, rxTime)
+	binary.BigEndian.PutUint64(key[4:], seq)
+	return key
+}
+
+func timePrefix(rxTime uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, rxTime)
+	return key
+}
+
+func (b *BoltStore) flusher() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.flushNow:
+		}
+		if err := b.Flush(); err != nil {
+			b.logger.Error("error flushing store, retrying with the next batch", zap.Int("pending", b.Pending()), zap.Error(err))
+		}
+	}
+}
+
+// Pending is how many appends are buffered and not yet committed
+func (b *BoltStore) Pending() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.pending)
+}
+
+// Flush commits every buffered append in a single transaction.
+// If the transaction fails the batch goes back in front of the buffer for the next flush.
+func (b *BoltStore) Flush() error {
+	b.commit.Lock()
+	defer b.commit.Unlock()
+
+	b.lock.Lock()
+	pending := b.pending
+	highWater := b.highWater
+	dirty := b.dirty
+	b.pending = nil
+	b.dirty = false
+	b.lock.Unlock()
+
+	if len(pending) == 0 && !dirty {
+		return nil
+	}
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range pending {
+			data, err := tx.CreateBucketIfNotExists([]byte(dataPrefix + p.collection))
+			if err != nil {
+				return err
+			}
+			lastBy, err := tx.CreateBucketIfNotExists([]byte(lastByPrefix + p.collection))
+			if err != nil {
+				return err
+			}
+			seq, err := data.NextSequence()
+			if err != nil {
+				return err
+			}
+			key := recordKey(p.rxTime, seq)
+			if err := data.Put(key, p.record); err != nil {
+				return err
+			}
+			for _, pk := range p.pks {
+				if err := lastBy.Put([]byte(pk), key); err != nil {
+					return err
+				}
+			}
+		}
+		if dirty {
+			meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+			if err != nil {
+				return err
+			}
+			hw, err := highWater.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			return meta.Put([]byte(highWaterKey), hw)
+		}
+		return nil
+	})
+	if err != nil {
+		b.lock.Lock()
+		b.pending = append(pending, b.pending...)
+		b.dirty = b.dirty || dirty
+		b.lock.Unlock()
+	}
+	return err
+}
+
+func (b *BoltStore) Append(collection string, rxTime uint32, record []byte, pks []string) error {
+	b.lock.Lock()
+	b.pending = append(b.pending, pendingRecord{
+		collection: collection,
+		rxTime:     rxTime,
+		record:     record,
+		pks:        append([]string(nil), pks...),
+	})
+	full := len(b.pending) >= flushSize
+	b.lock.Unlock()
+
+	if full {
+		select {
+		case b.flushNow <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// view runs fn in a read transaction along with the appends for collection not yet committed, in the order they were made.
+// Holding commit while both are taken means every record is in exactly one of them.
+func (b *BoltStore) view(collection string, fn func(tx *bolt.Tx, buffered []pendingRecord) error) error {
+	b.commit.RLock()
+	tx, err := b.db.Begin(false)
+	if err != nil {
+		b.commit.RUnlock()
+		return err
+	}
+	defer tx.Rollback()
+	var buffered []pendingRecord
+	b.lock.Lock()
+	for _, p := range b.pending {
+		if p.collection == collection {
+			buffered = append(buffered, p)
+		}
+	}
+	b.lock.Unlock()
+	b.commit.RUnlock()
+	return fn(tx, buffered)
+}
+
+// walk calls fn for records with from <= rxTime < to in key order, newest first if reverse, merging in buffered appends
+func (b *BoltStore) walk(collection string, from uint32, to uint64, reverse bool, limit int, fn func(record []byte) error) error {
+	return b.view(collection, func(tx *bolt.Tx, buffered []pendingRecord) error {
+		buffered = slices.DeleteFunc(buffered, func(p pendingRecord) bool {
+			return p.rxTime < from || uint64(p.rxTime) >= to
+		})
+		// committed keys sort by receive time then sequence, and buffered records will get later sequences
+		slices.SortStableFunc(buffered, func(x, y pendingRecord) int {
+			return cmp.Compare(x.rxTime, y.rxTime)
+		})
+
+		var k, v []byte
+		var c *bolt.Cursor
+		if data := tx.Bucket([]byte(dataPrefix + collection)); data != nil {
+			c = data.Cursor()
+			switch {
+			case !reverse:
+				k, v = c.Seek(timePrefix(from))
+			case to > math.MaxUint32:
+				k, v = c.Last()
+			default:
+				// start at the first key at or after `to` and walk backwards
+				if k, _ = c.Seek(timePrefix(uint32(to))); k == nil {
+					k, v = c.Last()
+				} else {
+					k, v = c.Prev()
+				}
+			}
+		}
+		inRange := func() bool {
+			if k == nil {
+				return false
+			}
+			rxTime := binary.BigEndian.Uint32(k)
+			return rxTime >= from && uint64(rxTime) < to
+		}
+
+		i, step := 0, 1
+		if reverse {
+			i, step = len(buffered)-1, -1
+		}
+		for count := 0; limit <= 0 || count < limit; count++ {
+			committed := inRange()
+			pending := i >= 0 && i < len(buffered)
+			if !committed && !pending {
+				break
+			}
+			takePending := pending && !committed
+			if pending && committed {
+				// on a tie the buffered record is the newer one
+				rxTime := binary.BigEndian.Uint32(k)
+				if reverse {
+					takePending = buffered[i].rxTime >= rxTime
+				} else {
+					takePending = buffered[i].rxTime < rxTime
+				}
+			}
+			if takePending {
+				if err := fn(buffered[i].record); err != nil {
+					return err
+				}
+				i += step
+				continue
+			}
+			if err := fn(v); err != nil {
+				return err
+			}
+			if reverse {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Next()
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) Recent(collection string, limit int, fn func(record []byte) error) error {
+	return b.walk(collection, 0, math.MaxUint32+1, true, limit, fn)
+}
+
+func (b *BoltStore) Range(collection string, from uint32, to uint32, limit int, fn func(record []byte) error) error {
+	return b.walk(collection, from, uint64(to), true, limit, fn)
+}
+
+func (b *BoltStore) RangeForward(collection string, from uint32, to uint32, limit int, fn func(record []byte) error) error {
+	return b.walk(collection, from, uint64(to), false, limit, fn)
+}
+
+func (b *BoltStore) LastBy(collection string, fn func(pk string, record []byte) error) error {
+	return b.view(collection, func(tx *bolt.Tx, buffered []pendingRecord) error {
+		// the newest buffered record for a key replaces whatever was committed under it
+		newest := map[string][]byte{}
+		for _, p := range buffered {
+			for _, pk := range p.pks {
+				newest[pk] = p.record
+			}
+		}
+		data := tx.Bucket([]byte(dataPrefix + collection))
+		lastBy := tx.Bucket([]byte(lastByPrefix + collection))
+		if data != nil && lastBy != nil {
+			err := lastBy.ForEach(func(pk, key []byte) error {
+				if _, ok := newest[string(pk)]; ok {
+					return nil
+				}
+				record := data.Get(key)
+				if record == nil {
+					return nil
+				}
+				return fn(string(pk), record)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for pk, record := range newest {
+			if err := fn(pk, record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) SetHighWater(t time.Time) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if t.After(b.highWater) {
+		b.highWater = t
+		b.dirty = true
+	}
+	return nil
+}
+
+func (b *BoltStore) HighWater() (time.Time, error) {
+	var hw time.Time
+	err := b.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		if meta == nil {
+			return nil
+		}
+		raw := meta.Get([]byte(highWaterKey))
+		if raw == nil {
+			return nil
+		}
+		return hw.UnmarshalBinary(raw)
+	})
+	if err != nil {
+		return hw, err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.highWater.After(hw) {
+		hw = b.highWater
+	}
+	return hw, nil
+}
+
+func (b *BoltStore) Close() error {
+	close(b.done)
+	b.wg.Wait()
+	if err := b.Flush(); err != nil {
+		b.db.Close()
+		return err
+	}
+	return b.db.Close()
+}
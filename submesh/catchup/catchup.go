@@ -1,58 +1,230 @@
 package catchup
 
 import (
-	"bufio"
+	"container/heap"
 	"context"
-	"fmt"
+	"io"
 	"os"
+	"runtime"
 	"submesh/submesh/contextkeys"
 	"submesh/submesh/fileencoding"
 	"submesh/submesh/filelog"
-	"submesh/submesh/parser"
+	"submesh/submesh/keyring"
+	"submesh/submesh/state"
+	"time"
 
-	"github.com/fxamacker/cbor/v2"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
 
+// Replay hands every entry of one file log, rotated backups included, to each of its targets
+type Replay struct {
+	Filename string
+	Targets  []context.Context
+}
+
+type source struct {
+	// segments are the backups oldest first, then the live file
+	segments []string
+	file     io.ReadCloser
+	name     string
+	dec      *fileencoding.Reader
+	entry    fileencoding.LogEntry
+	// damaged are the segments with stretches the reader had to skip
+	damaged []damage
+	targets []context.Context
+	// muted are the targets with logging off, since replayed packets were logged when they first arrived
+	muted []context.Context
+	keys  []*keyring.Keyring
+	// entries before each target's high-water mark are already in its store; the marks are whole seconds like the log
+	highWater []time.Time
+	// entries captured before cutoff are too old to replay
+	cutoff time.Time
+	// start is where reading begins: the cutoff, or later if every target's store already has what comes before
+	start time.Time
+	// end is when the last entry was written, for estimating progress
+	end    time.Time
+	logger *zap.Logger
+}
+
+type damage struct {
+	filename string
+	bytes    int64
+	records  int
+}
+
+// next reads the following entry, moving on to the next segment at the end of one, and reports false when all are done
+func (s *source) next() bool {
+	for {
+		if s.dec == nil && !s.open() {
+			return false
+		}
+		var entry fileencoding.LogEntry
+		if err := s.dec.Next(&entry); err != nil {
+			if err != io.EOF {
+				s.logger.Warn("error reading file log", zap.String("filename", s.name), zap.Error(err))
+			}
+			if s.dec.SkippedRecords > 0 {
+				s.damaged = append(s.damaged, damage{filename: s.name, bytes: s.dec.SkippedBytes, records: s.dec.SkippedRecords})
+			}
+			s.file.Close()
+			s.dec = nil
+			continue
+		}
+		if entry.TimeCaptured.Before(s.cutoff) {
+			continue
+		}
+		s.entry = entry
+		return true
+	}
+}
+
+// open starts the next segment that can be read, reporting false when none are left
+func (s *source) open() bool {
+	for len(s.segments) > 0 {
+		name := s.segments[0]
+		s.segments = s.segments[1:]
+		file, err := filelog.OpenAt(name, s.start)
+		if err != nil {
+			s.logger.Warn("error opening file log", zap.String("filename", name), zap.Error(err))
+			continue
+		}
+		s.file = file
+		s.name = name
+		s.dec = fileencoding.NewReader(file)
+		return true
+	}
+	return false
+}
+
+// covered is whether every target's store already holds everything up to at, the mark's own second excepted
+func (s *source) covered(at time.Time) bool {
+	for _, hw := range s.highWater {
+		if hw.IsZero() || !hw.After(at) {
+			return false
+		}
+	}
+	return len(s.highWater) > 0
+}
+
+// findSegments queues the backups worth reading, oldest first, then the live file
+func (s *source) findSegments(filename string) {
+	s.start = s.cutoff
+	var oldest time.Time
+	for i, hw := range s.highWater {
+		if hw.IsZero() {
+			// this target starts empty and needs everything
+			oldest = time.Time{}
+			break
+		}
+		if i == 0 || hw.Before(oldest) {
+			oldest = hw
+		}
+	}
+	if oldest.After(s.start) {
+		s.start = oldest
+	}
+	backups, err := filelog.Backups(filename)
+	if err != nil {
+		s.logger.Warn("error listing file log backups", zap.String("filename", filename), zap.Error(err))
+	}
+	skipped := 0
+	for _, b := range backups {
+		// a backup holds nothing newer than its rotation
+		if b.Rotated.Before(s.cutoff) || s.covered(b.Rotated) {
+			skipped++
+			continue
+		}
+		s.segments = append(s.segments, b.Filename)
+		s.end = b.Rotated
+	}
+	if info, err := os.Stat(filename); err == nil {
+		s.segments = append(s.segments, filename)
+		s.end = info.ModTime()
+	}
+	fields := []zap.Field{zap.String("filename", filename), zap.Int("backups", len(backups)-skipped), zap.Int("backups_skipped", skipped)}
+	if !s.start.IsZero() {
+		fields = append(fields, zap.Time("from", s.start))
+	}
+	s.logger.Info("replaying file log", fields...)
+}
+
+// sources orders the open logs by the capture time of their next entry
+type sources []*source
+
+func (s sources) Len() int { return len(s) }
+func (s sources) Less(i, j int) bool {
+	return s[i].entry.TimeCaptured.Before(s[j].entry.TimeCaptured)
+}
+func (s sources) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s *sources) Push(x any)   { *s = append(*s, x.(*source)) }
+func (s *sources) Pop() any {
+	old := *s
+	n := len(old)
+	item := old[n-1]
+	*s = old[:n-1]
+	return item
+}
+
+// CatchUp replays the file log in ctx into its state
 func CatchUp(ctx context.Context) {
 	filename := ctx.Value(contextkeys.RAWFileLogger).(*filelog.FileLog).Filename()
-	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
-	atomicLevel := ctx.Value(contextkeys.AtomicLevel).(*zap.AtomicLevel)
-	prevLevel := atomicLevel.Level()
-	defer atomicLevel.SetLevel(prevLevel)
-	// Mute Logger for Info
-	atomicLevel.SetLevel(zap.PanicLevel)
+	CatchUpAll(ctx, []Replay{{Filename: filename, Targets: []context.Context{ctx}}})
+}
 
-	if _, err := os.Stat(filename); err == nil {
-		// open file and read line by line
+// CatchUpAll replays several file logs at once, interleaved by capture time so a target fed by more than one sees them in order.
+// Entries older than submesh.catchup.max_age or from before submesh.catchup.since are left out
+func CatchUpAll(ctx context.Context, replays []Replay) {
+	logger := ctx.Value(contextkeys.Logger).(*zap.Logger)
 
-		file, err := os.Open(filename)
+	var cutoff time.Time
+	if maxAge := viper.GetDuration("submesh.catchup.max_age"); maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge)
+	}
+	if since := viper.GetString("submesh.catchup.since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
 		if err != nil {
-			logger.Fatal("error opening file", zap.Error(err))
-		}
-		defer file.Close()
-
-		count := 0
-		reader := bufio.NewReader(file)
-		dec := cbor.NewDecoder(reader)
-		for {
-			var logEntry fileencoding.LogEntry
-			if err := dec.Decode(&logEntry); err != nil {
-				if err.Error() == "EOF" {
-					return
-				}
-				fmt.Println("error decoding cbor", err)
-				break
-			}
+			logger.Fatal("invalid submesh.catchup.since", zap.Error(err))
+		}
+		if t.After(cutoff) {
+			cutoff = t
+		}
+	}
+	open := &sources{}
+	all := []*source{}
+	p := &progress{logger: logger, interval: viper.GetDuration("submesh.catchup.progress_interval")}
+	for _, r := range replays {
+		s := &source{targets: r.Targets, cutoff: cutoff, logger: logger}
+		all = append(all, s)
+		for _, target := range r.Targets {
+			s.muted = append(s.muted, context.WithValue(target, contextkeys.Logger, zap.NewNop()))
+			s.keys = append(s.keys, target.Value(contextkeys.Keyring).(*keyring.Keyring))
+			// marks from before the log was truncated to seconds carry a fraction the log never had
+			s.highWater = append(s.highWater, target.Value(contextkeys.State).(*state.State).HighWater().Truncate(time.Second))
+		}
+		s.findSegments(r.Filename)
+		if s.end.After(p.to) {
+			p.to = s.end
+		}
+		if s.next() {
+			heap.Push(open, s)
+		}
+	}
+	if open.Len() > 0 {
+		p.from = (*open)[0].entry.TimeCaptured
+	}
 
-			parser.HandleRawPayload(ctx, logEntry.TimeCaptured, logEntry.Packet, true)
-			count += 1
-			if count%10000 == 0 {
-				fmt.Println("catching up", count)
-			}
-			if ctx.Err() != nil {
-				break
-			}
+	workers := viper.GetInt("submesh.catchup.workers")
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	p.start()
+	replay(ctx, open, workers, p)
+	p.finish()
+
+	for _, s := range all {
+		for _, d := range s.damaged {
+			logger.Warn("skipped damaged entries in file log, submesh fsck can repair it", zap.String("filename", d.filename), zap.Int("stretches", d.records), zap.Int64("bytes", d.bytes))
 		}
 	}
 }
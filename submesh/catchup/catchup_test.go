@@ -0,0 +1,123 @@
+package catchup
+
+import (
+	"context"
+	"path/filepath"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/filelog"
+	"submesh/submesh/keyring"
+	"submesh/submesh/parser"
+	"submesh/submesh/state"
+	"testing"
+	"time"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+const testTopic = "msh/US/2/e/LongFast/!0000abcd"
+
+func testKeys(t *testing.T) *keyring.Keyring {
+	t.Helper()
+	keys, err := keyring.NewKeyringWithDefault(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func feedCtx(t *testing.T, log *filelog.FileLog, st *state.State) context.Context {
+	t.Helper()
+	keys := testKeys(t)
+	ctx := context.WithValue(context.Background(), contextkeys.Logger, zap.NewNop())
+	ctx = context.WithValue(ctx, contextkeys.Keyring, keys)
+	ctx = context.WithValue(ctx, contextkeys.State, st)
+	return context.WithValue(ctx, contextkeys.RAWFileLogger, log)
+}
+
+// textPacket is a chat from node 0x1234 on the default channel, encrypted the way a gateway uplinks it
+func textPacket(t *testing.T, id uint32, text string) []byte {
+	t.Helper()
+	channel := testKeys(t).Channels()[0]
+	encrypted, err := parser.EncryptData(channel.Key, id, 0x1234, &meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(text),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := proto.Marshal(&meshtastic.ServiceEnvelope{
+		ChannelId: channel.Name,
+		GatewayId: "!0000abcd",
+		Packet: &meshtastic.MeshPacket{
+			From:           0x1234,
+			To:             0xffffffff,
+			Id:             id,
+			Channel:        channel.Hash,
+			PayloadVariant: &meshtastic.MeshPacket_Encrypted{Encrypted: encrypted},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+// TestCatchUpAfterSnapshotMidSecond restores a snapshot taken between two entries logged in the same second
+// and checks catchup brings back the later one without repeating the earlier
+func TestCatchUpAfterSnapshotMidSecond(t *testing.T) {
+	dir := t.TempDir()
+	logName := filepath.Join(dir, "log.cbor")
+	snapshotName := filepath.Join(dir, "snapshot.cbor")
+
+	// leave the rest of the second for both entries
+	if left := time.Until(time.Now().Truncate(time.Second).Add(time.Second)); left < 500*time.Millisecond {
+		time.Sleep(left)
+	}
+
+	log := filelog.NewFileLog(logName)
+	live := state.NewState()
+	ctx := feedCtx(t, log, live)
+
+	first := textPacket(t, 1, "first")
+	at, err := log.Write(testTopic, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser.HandlePayload(ctx, at, testTopic, first, false)
+	hw, err := live.WriteSnapshot(snapshotName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// logged, then lost to a crash before it was handled
+	second, err := log.Write(testTopic, textPacket(t, 2, "second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	if !second.Equal(hw) {
+		t.Skipf("entries landed in different seconds (%v, %v)", hw, second)
+	}
+
+	restored := state.NewState()
+	if err := restored.RestoreSnapshot(snapshotName); err != nil {
+		t.Fatal(err)
+	}
+	CatchUpAll(ctx, []Replay{{Filename: logName, Targets: []context.Context{feedCtx(t, log, restored)}}})
+
+	chats := restored.Chats.All()
+	if len(chats) != 2 {
+		t.Fatalf("got %d chats after catchup, want 2", len(chats))
+	}
+	seen := map[string]int{}
+	for _, c := range chats {
+		seen[c.Underlying]++
+	}
+	if seen["first"] != 1 || seen["second"] != 1 {
+		t.Errorf("got chats %v, want first and second once each", seen)
+	}
+	if n := restored.Receptions.Count(0x1234, 1); n != 1 {
+		t.Errorf("first packet has %d receptions, want 1", n)
+	}
+}
@@ -0,0 +1,82 @@
+package catchup
+
+import (
+	"container/heap"
+	"context"
+	"submesh/submesh/fileencoding"
+	"submesh/submesh/keyring"
+	"submesh/submesh/parser"
+	"sync"
+)
+
+// jobsPerWorker is how far reading may run ahead of storing, per worker
+const jobsPerWorker = 64
+
+// job is one log entry on its way to the targets that don't have it yet
+type job struct {
+	entry   fileencoding.LogEntry
+	targets []context.Context
+	keys    []*keyring.Keyring
+	decoded []*parser.Decoded
+	// done is closed once a worker has decoded the entry for every target
+	done chan struct{}
+}
+
+// replay feeds the targets from open in capture order until every source is done.
+// One goroutine reads and merges the logs, workers unmarshal and decrypt, and the results are stored in the order they were read
+func replay(ctx context.Context, open *sources, workers int, p *progress) {
+	work := make(chan *job, workers*jobsPerWorker)
+	ordered := make(chan *job, workers*jobsPerWorker)
+
+	go func() {
+		defer close(ordered)
+		defer close(work)
+		for open.Len() > 0 && ctx.Err() == nil {
+			s := (*open)[0]
+			j := &job{entry: s.entry, done: make(chan struct{})}
+			for i := range s.targets {
+				// the mark's own second is replayed too, since more may have been logged in it after the mark was taken;
+				// what the target already has is caught by its dedup
+				if !s.highWater[i].IsZero() && s.entry.TimeCaptured.Before(s.highWater[i]) {
+					continue
+				}
+				j.targets = append(j.targets, s.muted[i])
+				j.keys = append(j.keys, s.keys[i])
+			}
+			work <- j
+			ordered <- j
+
+			if s.next() {
+				heap.Fix(open, 0)
+			} else {
+				heap.Pop(open)
+			}
+		}
+		for _, s := range *open {
+			s.file.Close()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				for _, keys := range j.keys {
+					j.decoded = append(j.decoded, parser.Decode(keys, j.entry.Topic, j.entry.Packet))
+				}
+				close(j.done)
+			}
+		}()
+	}
+
+	for j := range ordered {
+		<-j.done
+		for i, target := range j.targets {
+			parser.HandleDecoded(target, j.entry.TimeCaptured, j.decoded[i], true)
+		}
+		p.add(j.entry.TimeCaptured)
+	}
+	wg.Wait()
+}
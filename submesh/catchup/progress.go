@@ -0,0 +1,56 @@
+package catchup
+
+import (
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// progress logs how far catchup has got every interval. The time left is estimated from how much of the
+// span between the first and last entries has been replayed, so it's rough when traffic was uneven
+type progress struct {
+	logger   *zap.Logger
+	interval time.Duration
+	// from and to are the capture times of the first and last entries
+	from time.Time
+	to   time.Time
+
+	started         time.Time
+	records         int
+	reported        time.Time
+	reportedRecords int
+}
+
+func (p *progress) start() {
+	p.started = time.Now()
+	p.reported = p.started
+}
+
+// add counts an entry captured at at
+func (p *progress) add(at time.Time) {
+	p.records++
+	// checking the clock for every entry would show up in the profile
+	if p.interval <= 0 || p.records%256 != 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.reported) < p.interval {
+		return
+	}
+	rate := float64(p.records-p.reportedRecords) / now.Sub(p.reported).Seconds()
+	fields := []zap.Field{zap.Int("records", p.records), zap.Float64("records_per_sec", math.Round(rate)), zap.Time("at", at)}
+	if done := at.Sub(p.from); done > 0 && p.to.After(at) {
+		fraction := float64(done) / float64(p.to.Sub(p.from))
+		eta := time.Duration(float64(now.Sub(p.started)) * (1 - fraction) / fraction)
+		fields = append(fields, zap.Float64("percent", math.Round(fraction*1000)/10), zap.Duration("eta", eta.Round(time.Second)))
+	}
+	p.logger.Info("catching up", fields...)
+	p.reported = now
+	p.reportedRecords = p.records
+}
+
+func (p *progress) finish() {
+	took := time.Since(p.started)
+	p.logger.Info("caught up", zap.Int("records", p.records), zap.Duration("took", took.Round(time.Millisecond)), zap.Float64("records_per_sec", math.Round(float64(p.records)/took.Seconds())))
+}
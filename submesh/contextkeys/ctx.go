@@ -10,4 +10,14 @@ const (
 	Config         ContextKey = "config"
 	AtomicLevel    ContextKey = "atomicLevel"
 	AppVersion     ContextKey = "AppVersion"
+	Keyring        ContextKey = "keyring"
+	Hub            ContextKey = "hub"
+	Search         ContextKey = "search"
+	Feeds          ContextKey = "feeds"
+	Brokers        ContextKey = "brokers"
+	Downlink       ContextKey = "downlink"
+	Metrics        ContextKey = "metrics"
+	FeedMetrics    ContextKey = "feedMetrics"
+	Alerts         ContextKey = "alerts"
+	Tiles          ContextKey = "tiles"
 )
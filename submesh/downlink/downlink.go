@@ -0,0 +1,148 @@
+package downlink
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"submesh/submesh/keyring"
+	"submesh/submesh/mqtt"
+	"submesh/submesh/parser"
+	"time"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultTopic is where gateways with downlink enabled listen, per channel
+const DefaultTopic = "msh/US/2/e/{channel}/{gateway}"
+
+// MaxTextBytes keeps a text message inside a single packet
+const MaxTextBytes = 200
+
+const Broadcast = 0xffffffff
+
+const publishTimeout = 10 * time.Second
+
+// ErrInvalid marks messages that can't be sent as asked, as opposed to a broker failure
+var ErrInvalid = errors.New("invalid message")
+
+type Message struct {
+	Channel string
+	// To is a node id, or Broadcast
+	To   uint32
+	Text string
+}
+
+// Sent is what went out, for the caller to show
+type Sent struct {
+	Id      uint32
+	From    uint32
+	To      uint32
+	Channel string
+	Topic   string
+}
+
+// Sender publishes text messages into the mesh as a virtual node
+type Sender struct {
+	NodeId   uint32
+	Topic    string
+	HopLimit uint32
+	broker   *mqtt.Status
+	// deliver shows the sent packet in our own feeds
+	deliver func(topic string, payload []byte)
+}
+
+func NewSender(broker *mqtt.Status, nodeId uint32, deliver func(topic string, payload []byte)) *Sender {
+	return &Sender{
+		NodeId:   nodeId,
+		Topic:    DefaultTopic,
+		HopLimit: 3,
+		broker:   broker,
+		deliver:  deliver,
+	}
+}
+
+func (s *Sender) gatewayId() string {
+	return keyring.FormatNodeId(s.NodeId)
+}
+
+func packetId() (uint32, error) {
+	b := make([]byte, 4)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		// zero means no id and would slip past dedup
+		if id := binary.LittleEndian.Uint32(b); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// Send encrypts text with the channel's key and publishes it to the downlink topic
+func (s *Sender) Send(ctx context.Context, keys *keyring.Keyring, m Message) (*Sent, error) {
+	text := strings.TrimSpace(m.Text)
+	if text == "" {
+		return nil, fmt.Errorf("%w: empty text", ErrInvalid)
+	}
+	if len(text) > MaxTextBytes {
+		return nil, fmt.Errorf("%w: text is %d bytes, at most %d fit in a packet", ErrInvalid, len(text), MaxTextBytes)
+	}
+	var channel *keyring.ChannelKey
+	for _, ch := range keys.Channels() {
+		if ch.Name == m.Channel {
+			channel = &ch
+			break
+		}
+	}
+	if channel == nil {
+		return nil, fmt.Errorf("%w: unknown channel %q", ErrInvalid, m.Channel)
+	}
+	if channel.Key == nil {
+		return nil, fmt.Errorf("%w: channel %q has no key", ErrInvalid, m.Channel)
+	}
+
+	id, err := packetId()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := parser.EncryptData(channel.Key, id, s.NodeId, &meshtastic.Data{
+		Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP,
+		Payload: []byte(text),
+	})
+	if err != nil {
+		return nil, err
+	}
+	envelope := &meshtastic.ServiceEnvelope{
+		Packet: &meshtastic.MeshPacket{
+			From:           s.NodeId,
+			To:             m.To,
+			Id:             id,
+			Channel:        channel.Hash,
+			HopLimit:       s.HopLimit,
+			HopStart:       s.HopLimit,
+			RxTime:         uint32(time.Now().Unix()),
+			PayloadVariant: &meshtastic.MeshPacket_Encrypted{Encrypted: encrypted},
+		},
+		ChannelId: channel.Name,
+		GatewayId: s.gatewayId(),
+	}
+	payload, err := proto.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := strings.NewReplacer("{channel}", channel.Name, "{gateway}", s.gatewayId()).Replace(s.Topic)
+	pubCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	if err := s.broker.Publish(pubCtx, topic, payload, 1, false); err != nil {
+		return nil, err
+	}
+	if s.deliver != nil {
+		s.deliver(topic, payload)
+	}
+	return &Sent{Id: id, From: s.NodeId, To: m.To, Channel: channel.Name, Topic: topic}, nil
+}
@@ -0,0 +1,149 @@
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"submesh/submesh/keyring"
+	"submesh/submesh/mqtt"
+	"submesh/submesh/state"
+
+	"github.com/spf13/viper"
+)
+
+// MergedName is the feed that sees every other feed at once
+const MergedName = "all"
+
+// DefaultName is the only feed when none are configured
+const DefaultName = "default"
+
+type KeysConfig struct {
+	Channels []keyring.ChannelConfig `mapstructure:"channels"`
+	Nodes    []keyring.NodeConfig    `mapstructure:"nodes"`
+}
+
+// Config is one entry of feeds; keys fall back to the top level section, brokers to every top level broker
+type Config struct {
+	Name    string       `mapstructure:"name"`
+	Topics  []string     `mapstructure:"topics"`
+	Keys    *KeysConfig  `mapstructure:"keys"`
+	Brokers []string     `mapstructure:"brokers"`
+	MQTT    *mqtt.Broker `mapstructure:"mqtt"`
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ConfigsFromViper reads feeds, or makes a single default feed out of mqtt.topics or the brokers' topics
+func ConfigsFromViper() ([]Config, error) {
+	var configs []Config
+	if err := viper.UnmarshalKey("feeds", &configs); err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		topics := viper.GetStringSlice("mqtt.topics")
+		if len(topics) == 0 {
+			// with only mqtt.brokers the default feed takes whatever they subscribe to
+			brokers, err := mqtt.BrokersFromViper()
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range brokers {
+				topics = append(topics, b.Topics...)
+			}
+		}
+		return []Config{{Name: DefaultName, Topics: topics}}, nil
+	}
+	seen := map[string]bool{}
+	for _, c := range configs {
+		if !validName.MatchString(c.Name) {
+			return nil, fmt.Errorf("feed name %q must be letters, digits, - or _", c.Name)
+		}
+		if c.Name == MergedName || seen[c.Name] {
+			return nil, fmt.Errorf("feed name %q is reserved or used twice", c.Name)
+		}
+		if len(c.Topics) == 0 {
+			return nil, fmt.Errorf("feed %q has no topics", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return configs, nil
+}
+
+// Keyring builds the feed's own keys, or returns fallback when it has none
+func (c *Config) Keyring(fallback *keyring.Keyring) (*keyring.Keyring, error) {
+	if c.Keys == nil {
+		return fallback, nil
+	}
+	return keyring.NewKeyringWithDefault(c.Keys.Channels, c.Keys.Nodes)
+}
+
+// Broker is the feed's private broker, named after the feed, or nil when it has none
+func (c *Config) Broker() *mqtt.Broker {
+	if c.MQTT == nil || c.MQTT.Host == "" {
+		return nil
+	}
+	broker := *c.MQTT
+	broker.Name = c.Name
+	broker.Defaults()
+	return &broker
+}
+
+// Feed is one named view with its own state; Ctx carries the state, keys, file log, hub and search index
+type Feed struct {
+	Name   string
+	Topics []string
+	Ctx    context.Context
+	State  *state.State
+}
+
+type Feeds struct {
+	list   []*Feed
+	merged *Feed
+}
+
+// NewFeeds groups the configured feeds; merged is nil when there is only one
+func NewFeeds(list []*Feed, merged *Feed) *Feeds {
+	return &Feeds{list: list, merged: merged}
+}
+
+// List is every feed with a subscription of its own, in config order
+func (f *Feeds) List() []*Feed {
+	return f.list
+}
+
+func (f *Feeds) Merged() *Feed {
+	return f.merged
+}
+
+// Default is the merged feed, or the only one
+func (f *Feeds) Default() *Feed {
+	if f.merged != nil {
+		return f.merged
+	}
+	return f.list[0]
+}
+
+// Get finds a feed by name, including the merged one
+func (f *Feeds) Get(name string) *Feed {
+	if f.merged != nil && name == f.merged.Name {
+		return f.merged
+	}
+	for _, feed := range f.list {
+		if feed.Name == name {
+			return feed
+		}
+	}
+	return nil
+}
+
+// Names is what the web switcher offers; empty when there is nothing to switch between
+func (f *Feeds) Names() []string {
+	if f.merged == nil {
+		return nil
+	}
+	names := []string{f.merged.Name}
+	for _, feed := range f.list {
+		names = append(names, feed.Name)
+	}
+	return names
+}
@@ -0,0 +1,126 @@
+package feeds
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"submesh/submesh/mqtt"
+	"submesh/submesh/parser"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// TopicMatches reports whether topic falls under an mqtt subscription filter with + and # wildcards
+func TopicMatches(filter string, topic string) bool {
+	filters := strings.Split(filter, "/")
+	levels := strings.Split(topic, "/")
+	for i, f := range filters {
+		if f == "#" {
+			return true
+		}
+		if i >= len(levels) {
+			return false
+		}
+		if f != "+" && f != levels[i] {
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
+
+// Wants reports whether a message on topic belongs in the feed
+func (f *Feed) Wants(topic string) bool {
+	for _, filter := range f.Topics {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Router hands messages from every broker to the feeds attached to it, dropping copies another broker already delivered
+type Router struct {
+	// Window is how long a payload is remembered; zero turns cross-broker dedup off
+	Window   time.Duration
+	attached map[string][]*Feed
+	merged   *Feed
+	seen     map[[sha256.Size]byte]time.Time
+	swept    time.Time
+	lock     sync.Mutex
+}
+
+func NewRouter(merged *Feed, window time.Duration) *Router {
+	return &Router{
+		Window:   window,
+		attached: map[string][]*Feed{},
+		merged:   merged,
+		seen:     map[[sha256.Size]byte]time.Time{},
+	}
+}
+
+// Attach subscribes a feed to a broker by name
+func (r *Router) Attach(broker string, feed *Feed) {
+	r.attached[broker] = append(r.attached[broker], feed)
+}
+
+// Attached is every feed subscribed to the broker
+func (r *Router) Attached(broker string) []*Feed {
+	return r.attached[broker]
+}
+
+// duplicate remembers the payload and reports whether it was already seen within the window
+func (r *Router) duplicate(payload []byte, at time.Time) bool {
+	if r.Window <= 0 {
+		return false
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if at.Sub(r.swept) >= r.Window {
+		for key, prev := range r.seen {
+			if at.Sub(prev) >= r.Window {
+				delete(r.seen, key)
+			}
+		}
+		r.swept = at
+	}
+	key := sha256.Sum256(payload)
+	if prev, ok := r.seen[key]; ok && at.Sub(prev) < r.Window {
+		return true
+	}
+	r.seen[key] = at
+	return false
+}
+
+// Handler is the message callback for one broker
+func (r *Router) Handler(broker string, status *mqtt.Status) func(ctx context.Context, msg paho.PublishReceived) {
+	return func(ctx context.Context, msg paho.PublishReceived) {
+		duplicate := r.duplicate(msg.Packet.Payload, time.Now())
+		status.Received(duplicate)
+		if duplicate {
+			return
+		}
+		r.deliver(broker, msg)
+	}
+}
+
+func (r *Router) deliver(broker string, msg paho.PublishReceived) {
+	var captured time.Time
+	for _, feed := range r.attached[broker] {
+		if feed.Wants(msg.Packet.Topic) {
+			captured = parser.HandleMQTTMessage(feed.Ctx, msg)
+		}
+	}
+	// the merged feed replays the other feeds' logs, so it takes the time one of them logged
+	if !captured.IsZero() && r.merged != nil {
+		parser.HandlePayload(r.merged.Ctx, captured, msg.Packet.Topic, msg.Packet.Payload, false)
+	}
+}
+
+// Inject hands a message we published ourselves to the broker's feeds, so it shows up even if the broker never echoes it back
+func (r *Router) Inject(broker string, topic string, payload []byte) {
+	// remembering it drops the echo
+	r.duplicate(payload, time.Now())
+	r.deliver(broker, paho.PublishReceived{Packet: &paho.Publish{Topic: topic, Payload: payload}})
+}
@@ -0,0 +1,158 @@
+package fileencoding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// every entry is a cbor map of three items whose first key is 1
+var entryStart = []byte{0xa3, 0x01}
+
+const (
+	// readChunk is how much is read from the file at a time
+	readChunk = 256 * 1024
+	// maxEntry is the largest entry the reader waits for; anything longer is corrupt
+	maxEntry = 64 * 1024
+)
+
+// earliestCapture is before any log was written, so older times mean a record isn't what it looks like
+var earliestCapture = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var decMode, _ = cbor.DecOptions{
+	DupMapKey:         cbor.DupMapKeyEnforcedAPF,
+	ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+}.DecMode()
+
+var errInvalidEntry = errors.New("not a log entry")
+
+// Reader reads log entries, skipping over damaged stretches (like a write torn by a crash) to the next entry that decodes
+type Reader struct {
+	r   io.Reader
+	buf []byte
+	eof bool
+	err error
+	// corrupt is set while skipping, so a stretch is only counted once
+	corrupt bool
+
+	// Offset is where the next entry starts in the uncompressed stream, Start where the last one returned did
+	Offset int64
+	Start  int64
+	// SkippedBytes is how much damaged data was passed over
+	SkippedBytes int64
+	// SkippedRecords counts damaged stretches; a torn write is one
+	SkippedRecords int
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// fill reads until maxEntry bytes are buffered or the file ends
+func (r *Reader) fill() {
+	for !r.eof && r.err == nil && len(r.buf) < maxEntry {
+		chunk := make([]byte, readChunk)
+		n, err := io.ReadFull(r.r, chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.eof = true
+		} else if err != nil {
+			r.err = err
+		}
+	}
+}
+
+func (r *Reader) advance(n int) {
+	r.buf = r.buf[n:]
+	r.Offset += int64(n)
+}
+
+func validEntry(e *LogEntry) error {
+	if e.Topic == "" || len(e.Packet) == 0 || e.TimeCaptured.Before(earliestCapture) || e.TimeCaptured.After(time.Now().Add(24*time.Hour)) {
+		return errInvalidEntry
+	}
+	return nil
+}
+
+// Decode reads the entry data starts with
+func Decode(data []byte) (LogEntry, error) {
+	var e LogEntry
+	if _, err := decMode.UnmarshalFirst(data, &e); err != nil {
+		return e, err
+	}
+	return e, validEntry(&e)
+}
+
+// wellFormed is whether data starts with a valid entry followed by the start of another or nothing
+func wellFormed(data []byte) bool {
+	var e LogEntry
+	rest, err := decMode.UnmarshalFirst(data, &e)
+	return err == nil && validEntry(&e) == nil && (len(rest) == 0 || bytes.HasPrefix(rest, entryStart))
+}
+
+// torn reports whether an entry that decoded from the first n buffered bytes is really a torn one
+// whose claimed length swallowed the start of the entry written after it
+func (r *Reader) torn(n int) bool {
+	if n == len(r.buf) || bytes.HasPrefix(r.buf[n:], entryStart) {
+		return false
+	}
+	for at := 1; at < n; {
+		idx := bytes.Index(r.buf[at:n], entryStart)
+		if idx < 0 {
+			return false
+		}
+		if wellFormed(r.buf[at+idx:]) {
+			return true
+		}
+		at += idx + 1
+	}
+	return false
+}
+
+// Next reads the following entry into entry, returning io.EOF after the last one.
+// Errors other than io.EOF come from the underlying reader; damage is skipped and counted instead
+func (r *Reader) Next(entry *LogEntry) error {
+	for {
+		r.fill()
+		if len(r.buf) == 0 {
+			if r.err != nil {
+				return r.err
+			}
+			return io.EOF
+		}
+
+		var e LogEntry
+		rest, err := decMode.UnmarshalFirst(r.buf, &e)
+		if err == nil {
+			err = validEntry(&e)
+		}
+		if err == nil && r.torn(len(r.buf)-len(rest)) {
+			err = errInvalidEntry
+		}
+		if err == nil {
+			r.corrupt = false
+			r.Start = r.Offset
+			r.advance(len(r.buf) - len(rest))
+			*entry = e
+			return nil
+		}
+
+		if !r.corrupt {
+			r.corrupt = true
+			r.SkippedRecords++
+		}
+		// resume at the next place an entry could start
+		skip := len(r.buf)
+		if idx := bytes.Index(r.buf[1:], entryStart); idx >= 0 {
+			skip = idx + 1
+		} else if !r.eof && r.buf[len(r.buf)-1] == entryStart[0] {
+			// the start of an entry could be split across reads
+			skip = len(r.buf) - 1
+		}
+		r.SkippedBytes += int64(skip)
+		r.advance(skip)
+	}
+}
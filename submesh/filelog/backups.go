@@ -0,0 +1,99 @@
+package filelog
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// lumberjack names a rotated log <name>-<time>.<ext>, with .gz once compressed
+const (
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	compressSuffix   = ".gz"
+)
+
+// Backup is one rotated segment of a log
+type Backup struct {
+	Filename string
+	// Rotated is when lumberjack moved it aside; nothing in it is newer
+	Rotated    time.Time
+	Compressed bool
+}
+
+// Backups lists the rotated segments of the log at filename, oldest first
+func Backups(filename string) ([]Backup, error) {
+	dir := filepath.Dir(filename)
+	base := filepath.Base(filename)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	byTime := map[time.Time]Backup{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		compressed := strings.HasSuffix(name, compressSuffix)
+		stamp := strings.TrimSuffix(name, compressSuffix)
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		stamp = strings.TrimSuffix(strings.TrimPrefix(stamp, prefix), ext)
+		rotated, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		// while lumberjack compresses, both copies exist and only the plain one is whole
+		if existing, ok := byTime[rotated]; ok && !existing.Compressed {
+			continue
+		}
+		byTime[rotated] = Backup{Filename: filepath.Join(dir, name), Rotated: rotated, Compressed: compressed}
+	}
+
+	backups := make([]Backup, 0, len(byTime))
+	for _, b := range byTime {
+		backups = append(backups, b)
+	}
+	slices.SortFunc(backups, func(a, b Backup) int {
+		return a.Rotated.Compare(b.Rotated)
+	})
+	return backups, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// Open reads a log segment, decompressing it if it's gzipped
+func Open(filename string) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filename, compressSuffix) {
+		return file, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: reader, file: file}, nil
+}
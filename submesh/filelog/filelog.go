@@ -2,7 +2,9 @@ package filelog
 
 import (
 	"fmt"
+	"os"
 	"submesh/submesh/fileencoding"
+	"sync"
 	"time"
 
 	"github.com/fxamacker/cbor/v2"
@@ -12,10 +14,18 @@ import (
 
 type FileLog struct {
 	lumberjack *lumberjack.Logger
+	encMode    cbor.EncMode
+
+	lock sync.Mutex
+	// size is how much of the live segment has been written, so the next entry's offset
+	size        int64
+	index       *os.File
+	lastIndexed int64
 }
 
 func NewFileLog(filename string) *FileLog {
-	return &FileLog{
+	encMode, _ := cbor.CoreDetEncOptions().EncMode()
+	f := &FileLog{
 		lumberjack: &lumberjack.Logger{
 			Filename:   filename,
 			MaxSize:    viper.GetInt("submesh.db.max_megs"),
@@ -23,14 +33,65 @@ func NewFileLog(filename string) *FileLog {
 			MaxAge:     viper.GetInt("submesh.db.max_age"),
 			Compress:   true,
 		},
+		encMode: encMode,
+	}
+	if info, err := os.Stat(filename); err == nil {
+		f.size = info.Size()
 	}
+	f.openIndex()
+	return f
 }
+
+// openIndex continues the live segment's index, first dropping a torn point
+// and any past the end of a segment that was cut short
+func (f *FileLog) openIndex() {
+	if _, err := os.Stat(IndexName(f.Filename())); os.IsNotExist(err) && f.size > 0 {
+		// a log from before indexes were kept
+		BuildIndex(f.Filename())
+	}
+	points, _ := ReadIndex(f.Filename())
+	for len(points) > 0 && points[len(points)-1].Offset >= f.size {
+		points = points[:len(points)-1]
+	}
+	if info, err := os.Stat(IndexName(f.Filename())); err == nil && info.Size() != int64(len(points)*indexPointSize) {
+		WriteIndex(f.Filename(), points)
+	}
+	f.lastIndexed = 0
+	if len(points) > 0 {
+		f.lastIndexed = points[len(points)-1].Time
+	}
+	index, err := os.OpenFile(IndexName(f.Filename()), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		// the log still works without an index, just slower to seek
+		index = nil
+	}
+	f.index = index
+}
+
+// rotated moves the live index over to the backup lumberjack just made
+func (f *FileLog) rotated() {
+	if f.index != nil {
+		f.index.Close()
+	}
+	if backups, err := Backups(f.Filename()); err == nil && len(backups) > 0 {
+		os.Rename(IndexName(f.Filename()), IndexName(backups[len(backups)-1].Filename))
+	}
+	removeOrphanIndexes(f.Filename())
+	f.size = 0
+	f.openIndex()
+}
+
 func (f *FileLog) Filename() string {
 	return f.lumberjack.Filename
 }
 
 func (f *FileLog) Close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
 	f.lumberjack.Close()
+	if f.index != nil {
+		f.index.Close()
+	}
 }
 
 func (f *FileLog) WriteLine(source string, line string) error {
@@ -39,20 +100,34 @@ func (f *FileLog) WriteLine(source string, line string) error {
 	_, err := f.lumberjack.Write([]byte(fmt.Sprintf("%d,%s,%s\n", curTime, source, line)))
 	return err
 }
-func (f *FileLog) Write(source string, packet []byte) error {
-	// get current unixtime
-	em, err := cbor.CoreDetEncOptions().EncMode()
-	if err != nil {
-		return err
-	}
-
-	enc := em.NewEncoder(f.lumberjack)
 
+// Write appends an entry and returns the capture time it was stamped with, which is what catchup later compares
+// high-water marks against. The log keeps whole seconds, so the time is truncated to match what's read back
+func (f *FileLog) Write(source string, packet []byte) (time.Time, error) {
 	rm := fileencoding.LogEntry{
-		TimeCaptured: time.Now(),
+		TimeCaptured: time.Now().Truncate(time.Second),
 		Topic:        source,
 		Packet:       packet,
 	}
+	data, err := f.encMode.Marshal(rm)
+	if err != nil {
+		return rm.TimeCaptured, err
+	}
 
-	return enc.Encode(rm)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, err := f.lumberjack.Write(data); err != nil {
+		return rm.TimeCaptured, err
+	}
+	// lumberjack rotates inside Write, leaving only this entry in the new segment
+	if info, err := os.Stat(f.Filename()); err == nil && f.size > 0 && info.Size() == int64(len(data)) {
+		f.rotated()
+	}
+	offset := f.size
+	f.size += int64(len(data))
+	if f.index != nil && (offset == 0 || indexDue(f.lastIndexed, rm.TimeCaptured)) {
+		f.lastIndexed = rm.TimeCaptured.Unix()
+		f.index.Write(IndexPoint{Time: f.lastIndexed, Offset: offset}.encode())
+	}
+	return rm.TimeCaptured, nil
 }
@@ -0,0 +1,230 @@
+package filelog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"submesh/submesh/fileencoding"
+	"time"
+)
+
+// each log segment has a sidecar <segment>.idx of fixed size points, appended as the log is written
+const (
+	indexSuffix    = ".idx"
+	indexPointSize = 16
+	// indexInterval is how much log time passes between points
+	indexInterval = time.Minute
+)
+
+// IndexPoint is the offset of the first entry captured at Time or later
+type IndexPoint struct {
+	Time   int64
+	Offset int64
+}
+
+// IndexName is the index of a segment; a backup keeps its index name once gzipped
+func IndexName(segment string) string {
+	return strings.TrimSuffix(segment, compressSuffix) + indexSuffix
+}
+
+func (p IndexPoint) encode() []byte {
+	buf := make([]byte, indexPointSize)
+	binary.BigEndian.PutUint64(buf, uint64(p.Time))
+	binary.BigEndian.PutUint64(buf[8:], uint64(p.Offset))
+	return buf
+}
+
+// ReadIndex loads a segment's index, which is empty if it was never written
+func ReadIndex(segment string) ([]IndexPoint, error) {
+	data, err := os.ReadFile(IndexName(segment))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	points := make([]IndexPoint, 0, len(data)/indexPointSize)
+	// a torn last point is ignored
+	for i := 0; i+indexPointSize <= len(data); i += indexPointSize {
+		points = append(points, IndexPoint{
+			Time:   int64(binary.BigEndian.Uint64(data[i:])),
+			Offset: int64(binary.BigEndian.Uint64(data[i+8:])),
+		})
+	}
+	return points, nil
+}
+
+// WriteIndex replaces a segment's index
+func WriteIndex(segment string, points []IndexPoint) error {
+	buf := make([]byte, 0, len(points)*indexPointSize)
+	for _, p := range points {
+		buf = append(buf, p.encode()...)
+	}
+	return os.WriteFile(IndexName(segment), buf, 0644)
+}
+
+// indexDue is whether an entry captured at t needs a point, given the last one
+func indexDue(last int64, t time.Time) bool {
+	return last == 0 || t.Unix()-last >= int64(indexInterval/time.Second)
+}
+
+// BuildIndex scans a segment and writes its index from scratch
+func BuildIndex(segment string) error {
+	in, err := Open(segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	reader := fileencoding.NewReader(in)
+	points := []IndexPoint{}
+	var last int64
+	for {
+		var entry fileencoding.LogEntry
+		err := reader.Next(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if indexDue(last, entry.TimeCaptured) {
+			last = entry.TimeCaptured.Unix()
+			points = append(points, IndexPoint{Time: last, Offset: reader.Start})
+		}
+	}
+	return WriteIndex(segment, points)
+}
+
+// removeOrphanIndexes deletes the indexes of segments lumberjack has removed
+func removeOrphanIndexes(filename string) {
+	dir := filepath.Dir(filename)
+	base := filepath.Base(filename)
+	prefix := strings.TrimSuffix(base, filepath.Ext(base))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, indexSuffix) {
+			continue
+		}
+		segment := filepath.Join(dir, strings.TrimSuffix(name, indexSuffix))
+		if _, err := os.Stat(segment); err == nil {
+			continue
+		}
+		if _, err := os.Stat(segment + compressSuffix); err == nil {
+			continue
+		}
+		os.Remove(filepath.Join(dir, name))
+	}
+}
+
+type bufferedFile struct {
+	*bufio.Reader
+	io.Closer
+}
+
+var errStaleIndex = errors.New("index doesn't match segment")
+
+// OpenAt opens a segment positioned so the entries captured before t are mostly passed over,
+// using its index when it has one that matches; entries from t on are never skipped
+func OpenAt(segment string, t time.Time) (io.ReadCloser, error) {
+	points, err := ReadIndex(segment)
+	if err != nil || t.IsZero() {
+		return Open(segment)
+	}
+	// the last point strictly before t: everything ahead of it is older still
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time >= t.Unix() }) - 1
+	if i < 0 {
+		return Open(segment)
+	}
+	in, err := openAtPoint(segment, points[i])
+	if errors.Is(err, errStaleIndex) {
+		return Open(segment)
+	}
+	return in, err
+}
+
+func openAtPoint(segment string, p IndexPoint) (io.ReadCloser, error) {
+	in, err := Open(segment)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := in.(io.Seeker); ok {
+		_, err = seeker.Seek(p.Offset, io.SeekStart)
+	} else {
+		// gzipped, so read up to it without decoding anything
+		_, err = io.CopyN(io.Discard, in, p.Offset)
+	}
+	if err != nil {
+		in.Close()
+		if err == io.EOF {
+			return nil, errStaleIndex
+		}
+		return nil, err
+	}
+	// a segment replaced by a repaired copy can leave an index pointing at the wrong place
+	buffered := bufio.NewReaderSize(in, 64*1024)
+	head, _ := buffered.Peek(64 * 1024)
+	entry, err := fileencoding.Decode(head)
+	if err != nil || entry.TimeCaptured.Unix() != p.Time {
+		in.Close()
+		return nil, errStaleIndex
+	}
+	return bufferedFile{Reader: buffered, Closer: in}, nil
+}
+
+// ReadRange hands fn every entry of the log at filename, backups included, captured between since and until,
+// jumping to since through the indexes; a zero until reads to the end
+func ReadRange(filename string, since time.Time, until time.Time, fn func(entry *fileencoding.LogEntry) error) error {
+	backups, err := Backups(filename)
+	if err != nil {
+		return err
+	}
+	segments := []string{}
+	for _, b := range backups {
+		if !b.Rotated.Before(since) {
+			segments = append(segments, b.Filename)
+		}
+	}
+	if _, err := os.Stat(filename); err == nil {
+		segments = append(segments, filename)
+	}
+	for _, segment := range segments {
+		in, err := OpenAt(segment, since)
+		if err != nil {
+			return err
+		}
+		reader := fileencoding.NewReader(in)
+		for {
+			var entry fileencoding.LogEntry
+			err := reader.Next(&entry)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				in.Close()
+				return err
+			}
+			if entry.TimeCaptured.Before(since) {
+				continue
+			}
+			if !until.IsZero() && entry.TimeCaptured.After(until) {
+				in.Close()
+				return nil
+			}
+			if err := fn(&entry); err != nil {
+				in.Close()
+				return err
+			}
+		}
+		in.Close()
+	}
+	return nil
+}
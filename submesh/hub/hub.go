@@ -0,0 +1,113 @@
+package hub
+
+import (
+	"slices"
+	"submesh/submesh/types"
+	"sync"
+)
+
+const defaultBuffer = 64
+
+// Filter narrows a subscription; empty fields match everything
+type Filter struct {
+	PortNums []uint32
+	// Nodes match either the sender or the recipient
+	Nodes    []uint32
+	Channels []uint32
+}
+
+func (f Filter) Matches(m *types.ParsedMessage[types.MessageSummary]) bool {
+	if len(f.PortNums) > 0 && !slices.Contains(f.PortNums, m.Underlying.PortNum) {
+		return false
+	}
+	if len(f.Nodes) > 0 && !slices.Contains(f.Nodes, m.From) && !slices.Contains(f.Nodes, m.To) {
+		return false
+	}
+	if len(f.Channels) > 0 && !slices.Contains(f.Channels, m.Channel) {
+		return false
+	}
+	return true
+}
+
+type Subscription struct {
+	filter  Filter
+	ch      chan types.ParsedMessage[types.MessageSummary]
+	hub     *Hub
+	dropped uint64
+}
+
+// C delivers matching messages; it is closed when the subscription is
+func (s *Subscription) C() <-chan types.ParsedMessage[types.MessageSummary] {
+	return s.ch
+}
+
+func (s *Subscription) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// Dropped is how many messages were skipped because the subscriber fell behind
+func (s *Subscription) Dropped() uint64 {
+	s.hub.lock.RLock()
+	defer s.hub.lock.RUnlock()
+	return s.dropped
+}
+
+// Hub fans decoded packets out to live subscribers, never blocking the parser
+type Hub struct {
+	lock sync.RWMutex
+	subs map[*Subscription]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	return h.SubscribeBuffered(filter, defaultBuffer)
+}
+
+// SubscribeBuffered is Subscribe with room for size messages, for subscribers that can stall for a while
+func (h *Hub) SubscribeBuffered(filter Filter, size int) *Subscription {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := &Subscription{
+		filter: filter,
+		ch:     make(chan types.ParsedMessage[types.MessageSummary], size),
+		hub:    h,
+	}
+	h.subs[s] = struct{}{}
+	return s
+}
+
+func (h *Hub) unsubscribe(s *Subscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subs[s]; ok {
+		delete(h.subs, s)
+		close(s.ch)
+	}
+}
+
+func (h *Hub) Publish(m types.ParsedMessage[types.MessageSummary]) {
+	// write lock since dropped counters are updated
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for s := range h.subs {
+		if !s.filter.Matches(&m) {
+			continue
+		}
+		select {
+		case s.ch <- m:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+func (h *Hub) Subscribers() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.subs)
+}
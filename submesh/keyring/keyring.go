@@ -0,0 +1,228 @@
+package keyring
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// the well known "AQ==" key used by the default LongFast channel
+const defaultPSK = "1PG7OiApB1nwvP+rz05pAQ=="
+const defaultChannelName = "LongFast"
+
+type ChannelConfig struct {
+	Name string `mapstructure:"name"`
+	PSK  string `mapstructure:"psk"`
+}
+
+type ChannelKey struct {
+	Name string
+	Key  []byte
+	Hash uint32
+}
+
+// NodeConfig is one of our own nodes whose X25519 private key we hold
+type NodeConfig struct {
+	Id         string `mapstructure:"id"`
+	PrivateKey string `mapstructure:"private_key"`
+}
+
+type Keyring struct {
+	channels []ChannelKey
+	nodes    map[uint32]*ecdh.PrivateKey
+}
+
+func generateKey(key string) ([]byte, error) {
+	// Pad the key with '=' characters to ensure it's a valid base64 string
+	padding := (4 - len(key)%4) % 4
+	paddedKey := key + strings.Repeat("=", padding)
+
+	// Replace '-' with '+' and '_' with '/'
+	replacedKey := strings.ReplaceAll(paddedKey, "-", "+")
+	replacedKey = strings.ReplaceAll(replacedKey, "_", "/")
+
+	// Decode the base64-encoded key
+	return base64.StdEncoding.DecodeString(replacedKey)
+}
+
+// expandPSK turns a configured PSK into an AES key the same way the firmware does.
+// A nil key means the channel is unencrypted.
+func expandPSK(psk []byte) ([]byte, error) {
+	switch {
+	case len(psk) == 0:
+		return nil, nil
+	case len(psk) == 1:
+		// single byte keys are an index into the default key
+		if psk[0] == 0 {
+			return nil, nil
+		}
+		key, err := generateKey(defaultPSK)
+		if err != nil {
+			return nil, err
+		}
+		key[len(key)-1] += psk[0] - 1
+		return key, nil
+	case len(psk) < 16:
+		return append(psk, make([]byte, 16-len(psk))...), nil
+	case len(psk) == 16, len(psk) == 32:
+		return psk, nil
+	case len(psk) < 32:
+		return append(psk, make([]byte, 32-len(psk))...), nil
+	}
+	return nil, fmt.Errorf("psk too long: %d bytes", len(psk))
+}
+
+func xorHash(b []byte) uint8 {
+	var h uint8
+	for _, c := range b {
+		h ^= c
+	}
+	return h
+}
+
+// ChannelHash is the value meshtastic puts into MeshPacket.Channel for encrypted packets
+func ChannelHash(name string, key []byte) uint32 {
+	return uint32(xorHash([]byte(name)) ^ xorHash(key))
+}
+
+// FormatNodeId is the "!a1b2c3d4" form of a node id the firmware and the ui show
+func FormatNodeId(id uint32) string {
+	return fmt.Sprintf("!%08x", id)
+}
+
+// ParseNodeId accepts both "!a1b2c3d4" and decimal node ids
+func ParseNodeId(id string) (uint32, error) {
+	if strings.HasPrefix(id, "!") {
+		n, err := strconv.ParseUint(strings.TrimPrefix(id, "!"), 16, 32)
+		return uint32(n), err
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+func NewKeyring(channels []ChannelConfig, nodes []NodeConfig) (*Keyring, error) {
+	k := &Keyring{
+		nodes: make(map[uint32]*ecdh.PrivateKey),
+	}
+	for _, n := range nodes {
+		id, err := ParseNodeId(n.Id)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", n.Id, err)
+		}
+		raw, err := generateKey(n.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", n.Id, err)
+		}
+		priv, err := ecdh.X25519().NewPrivateKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %w", n.Id, err)
+		}
+		k.nodes[id] = priv
+	}
+	for _, ch := range channels {
+		psk, err := generateKey(ch.PSK)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q: %w", ch.Name, err)
+		}
+		key, err := expandPSK(psk)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q: %w", ch.Name, err)
+		}
+		if key == nil {
+			// nothing to decrypt with
+			continue
+		}
+		name := ch.Name
+		if name == "" && len(psk) == 1 && psk[0] == 1 {
+			name = defaultChannelName
+		}
+		k.channels = append(k.channels, ChannelKey{
+			Name: name,
+			Key:  key,
+			Hash: ChannelHash(name, key),
+		})
+	}
+	return k, nil
+}
+
+// NewKeyringFromConfig reads keys.channels and keys.nodes, falling back to the default LongFast key
+func NewKeyringFromConfig() (*Keyring, error) {
+	var channels []ChannelConfig
+	if err := viper.UnmarshalKey("keys.channels", &channels); err != nil {
+		return nil, err
+	}
+	var nodes []NodeConfig
+	if err := viper.UnmarshalKey("keys.nodes", &nodes); err != nil {
+		return nil, err
+	}
+	return NewKeyringWithDefault(channels, nodes)
+}
+
+// NewKeyringWithDefault is NewKeyring, using the default LongFast key when no channels are given
+func NewKeyringWithDefault(channels []ChannelConfig, nodes []NodeConfig) (*Keyring, error) {
+	if len(channels) == 0 {
+		channels = []ChannelConfig{{Name: defaultChannelName, PSK: "AQ=="}}
+	}
+	return NewKeyring(channels, nodes)
+}
+
+// Merge combines keyrings, keeping each distinct channel key and node once
+func Merge(rings ...*Keyring) *Keyring {
+	merged := &Keyring{nodes: make(map[uint32]*ecdh.PrivateKey)}
+	for _, k := range rings {
+		for _, ch := range k.channels {
+			if !slices.ContainsFunc(merged.channels, func(c ChannelKey) bool {
+				return c.Name == ch.Name && bytes.Equal(c.Key, ch.Key)
+			}) {
+				merged.channels = append(merged.channels, ch)
+			}
+		}
+		for id, priv := range k.nodes {
+			merged.nodes[id] = priv
+		}
+	}
+	return merged
+}
+
+func (k *Keyring) Channels() []ChannelKey {
+	return k.channels
+}
+
+// Candidates returns every channel key, with the ones whose hash matches first
+func (k *Keyring) Candidates(channelHash uint32) []ChannelKey {
+	matching := []ChannelKey{}
+	rest := []ChannelKey{}
+	for _, ch := range k.channels {
+		if ch.Hash == channelHash {
+			matching = append(matching, ch)
+		} else {
+			rest = append(rest, ch)
+		}
+	}
+	return append(matching, rest...)
+}
+
+// NameForHash returns the configured channel name for a channel hash, if any
+func (k *Keyring) NameForHash(channelHash uint32) string {
+	for _, ch := range k.channels {
+		if ch.Hash == channelHash {
+			return ch.Name
+		}
+	}
+	return ""
+}
+
+func (k *Keyring) Nodes() int {
+	return len(k.nodes)
+}
+
+// PrivateKeyFor returns the private key of one of our nodes, or nil if we don't own it
+func (k *Keyring) PrivateKeyFor(node uint32) *ecdh.PrivateKey {
+	return k.nodes[node]
+}
@@ -0,0 +1,124 @@
+package mbtiles
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNoTile is a tile the file doesn't have
+var ErrNoTile = errors.New("tile not found")
+
+var contentTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// MBTiles is a read-only raster tileset
+type MBTiles struct {
+	Name        string
+	Format      string
+	MinZoom     int
+	MaxZoom     int
+	Attribution string
+	// Bounds is left, bottom, right, top in degrees, nil when the metadata doesn't say
+	Bounds []float64
+	db     *sql.DB
+}
+
+// errNoSqlite is set when the binary was built without the cgo sqlite driver
+var errNoSqlite error
+
+func Open(path string) (*MBTiles, error) {
+	if errNoSqlite != nil {
+		return nil, errNoSqlite
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&immutable=1")
+	if err != nil {
+		return nil, err
+	}
+	m := &MBTiles{Format: "png", MaxZoom: -1, db: db}
+	if err := m.readMetadata(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if _, ok := contentTypes[m.Format]; !ok {
+		db.Close()
+		return nil, fmt.Errorf("%s holds %s tiles, only raster tiles are supported", path, m.Format)
+	}
+	if m.MaxZoom < 0 {
+		// older files leave the zoom range out of the metadata
+		if err := db.QueryRow("SELECT COALESCE(MIN(zoom_level), 0), COALESCE(MAX(zoom_level), 0) FROM tiles").Scan(&m.MinZoom, &m.MaxZoom); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *MBTiles) readMetadata() error {
+	rows, err := m.db.Query("SELECT name, value FROM metadata")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		switch name {
+		case "name":
+			m.Name = value
+		case "format":
+			m.Format = strings.ToLower(value)
+		case "minzoom":
+			m.MinZoom, _ = strconv.Atoi(value)
+		case "maxzoom":
+			if zoom, err := strconv.Atoi(value); err == nil {
+				m.MaxZoom = zoom
+			}
+		case "attribution":
+			m.Attribution = value
+		case "bounds":
+			bounds := []float64{}
+			for _, part := range strings.Split(value, ",") {
+				f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+				if err != nil {
+					break
+				}
+				bounds = append(bounds, f)
+			}
+			if len(bounds) == 4 {
+				m.Bounds = bounds
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func (m *MBTiles) ContentType() string {
+	return contentTypes[m.Format]
+}
+
+// Tile reads one tile in the xyz scheme web maps use; the file stores rows flipped (tms)
+func (m *MBTiles) Tile(z int, x int, y int) ([]byte, error) {
+	if z < 0 || z > 30 || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		return nil, ErrNoTile
+	}
+	row := (1 << z) - 1 - y
+	var data []byte
+	err := m.db.QueryRow("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?", z, x, row).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoTile
+	}
+	return data, err
+}
+
+func (m *MBTiles) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package mbtiles
+
+import "errors"
+
+func init() {
+	errNoSqlite = errors.New("reading MBTiles needs sqlite through cgo, and this binary was built with CGO_ENABLED=0")
+}
@@ -0,0 +1,5 @@
+//go:build cgo
+
+package mbtiles
+
+import _ "github.com/mattn/go-sqlite3"
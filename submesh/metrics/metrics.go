@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"strings"
+	"submesh/submesh/keyring"
+	"submesh/submesh/mqtt"
+	"submesh/submesh/state"
+	"sync"
+	"time"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "submesh"
+
+// heardWindow is how far back submesh_nodes_heard looks
+const heardWindow = time.Hour
+
+// Metrics owns the registry /metrics serves
+type Metrics struct {
+	Registry        *prometheus.Registry
+	packets         *prometheus.CounterVec
+	decryptFailures *prometheus.CounterVec
+	parseErrors     *prometheus.CounterVec
+	battery         *prometheus.GaugeVec
+	voltage         *prometheus.GaugeVec
+	channelUtil     *prometheus.GaugeVec
+	airUtilTx       *prometheus.GaugeVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "packets_total",
+			Help:      "Packets received live, after dedup, by port, channel name and topic.",
+		}, []string{"feed", "portnum", "channel", "topic"}),
+		decryptFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "decrypt_failures_total",
+			Help:      "Packets no configured key could decrypt, by channel name.",
+		}, []string{"feed", "channel"}),
+		parseErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "parse_errors_total",
+			Help:      "Messages that failed to decode, by stage.",
+		}, []string{"feed", "stage"}),
+		battery: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_battery_level_percent",
+			Help:      "Latest battery level from device metrics of nodes heard in the last hour; above 100 means powered.",
+		}, []string{"feed", "node"}),
+		voltage: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_voltage_volts",
+			Help:      "Latest voltage from device metrics of nodes heard in the last hour.",
+		}, []string{"feed", "node"}),
+		channelUtil: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_channel_utilization_percent",
+			Help:      "Latest channel utilization from device metrics of nodes heard in the last hour.",
+		}, []string{"feed", "node"}),
+		airUtilTx: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "node_air_util_tx_percent",
+			Help:      "Latest transmit airtime from device metrics of nodes heard in the last hour.",
+		}, []string{"feed", "node"}),
+	}
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.packets, m.decryptFailures, m.parseErrors,
+		m.battery, m.voltage, m.channelUtil, m.airUtilTx,
+	)
+	return m
+}
+
+// Feed adds the collectors for one feed and returns what its parser reports to
+func (m *Metrics) Feed(name string, st *state.State) *Feed {
+	labels := prometheus.Labels{"feed": name}
+	f := &Feed{
+		packets:         m.packets.MustCurryWith(labels),
+		decryptFailures: m.decryptFailures.MustCurryWith(labels),
+		parseErrors:     m.parseErrors.MustCurryWith(labels),
+		battery:         m.battery.MustCurryWith(labels),
+		voltage:         m.voltage.MustCurryWith(labels),
+		channelUtil:     m.channelUtil.MustCurryWith(labels),
+		airUtilTx:       m.airUtilTx.MustCurryWith(labels),
+		heard:           map[uint32]time.Time{},
+	}
+	m.Registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Name:        "dedup_hits_total",
+			Help:        "Live copies of a packet dropped because it was already processed.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(st.Dedup.Hits()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Name:        "nodes_heard",
+			Help:        "Nodes heard from in the last hour.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(f.heardSince(time.Now().Add(-heardWindow))) }),
+	)
+	return f
+}
+
+// Broker adds the connection counters for one broker
+func (m *Metrics) Broker(status *mqtt.Status) {
+	labels := prometheus.Labels{"broker": status.Snapshot().Name}
+	counter := func(name string, help string, value func(s mqtt.BrokerStatus) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "mqtt",
+			Name:        name,
+			Help:        help,
+			ConstLabels: labels,
+		}, func() float64 { return float64(value(status.Snapshot())) })
+	}
+	m.Registry.MustRegister(
+		counter("connects_total", "Successful connections, the first one included.", func(s mqtt.BrokerStatus) uint64 { return s.Connects }),
+		counter("messages_total", "Messages received, duplicates included.", func(s mqtt.BrokerStatus) uint64 { return s.Messages }),
+		counter("duplicates_total", "Messages another broker already delivered.", func(s mqtt.BrokerStatus) uint64 { return s.Duplicates }),
+		counter("published_total", "Messages submesh published.", func(s mqtt.BrokerStatus) uint64 { return s.Published }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   "mqtt",
+			Name:        "connected",
+			Help:        "1 while the broker connection is up.",
+			ConstLabels: labels,
+		}, func() float64 {
+			if status.Snapshot().Connected {
+				return 1
+			}
+			return 0
+		}),
+	)
+}
+
+// Republish counts the packets the republisher had to drop
+func (m *Metrics) Republish(dropped func() uint64) {
+	m.Registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "republish",
+		Name:      "dropped_total",
+		Help:      "Decoded packets not republished because the queue was full.",
+	}, func() float64 { return float64(dropped()) }))
+}
+
+// Feed is one feed's share of the metrics; every method is safe on nil
+type Feed struct {
+	packets         *prometheus.CounterVec
+	decryptFailures *prometheus.CounterVec
+	parseErrors     *prometheus.CounterVec
+	battery         *prometheus.GaugeVec
+	voltage         *prometheus.GaugeVec
+	channelUtil     *prometheus.GaugeVec
+	airUtilTx       *prometheus.GaugeVec
+	lock            sync.Mutex
+	heard           map[uint32]time.Time
+}
+
+// TopicLabel drops the gateway off the end of a topic, which would make a series per gateway
+func TopicLabel(topic string) string {
+	if idx := strings.LastIndex(topic, "/"); idx >= 0 && strings.HasPrefix(topic[idx+1:], "!") {
+		return topic[:idx]
+	}
+	return topic
+}
+
+func nodeLabel(node uint32) string {
+	return keyring.FormatNodeId(node)
+}
+
+func (f *Feed) Packet(portName string, channel string, topic string) {
+	if f == nil {
+		return
+	}
+	f.packets.WithLabelValues(portName, channel, TopicLabel(topic)).Inc()
+}
+
+func (f *Feed) DecryptFailure(channel string) {
+	if f == nil {
+		return
+	}
+	f.decryptFailures.WithLabelValues(channel).Inc()
+}
+
+// ParseError counts a failure at stage: envelope, json or payload
+func (f *Feed) ParseError(stage string) {
+	if f == nil {
+		return
+	}
+	f.parseErrors.WithLabelValues(stage).Inc()
+}
+
+// Heard notes a node was on the air at the given time
+func (f *Feed) Heard(node uint32, at time.Time) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if at.After(f.heard[node]) {
+		f.heard[node] = at
+	}
+}
+
+// heardSince counts nodes heard after since, forgetting the rest along with their device metrics,
+// so nodes that left the mesh don't keep a series each
+func (f *Feed) heardSince(since time.Time) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for node, at := range f.heard {
+		if at.Before(since) {
+			delete(f.heard, node)
+			label := nodeLabel(node)
+			f.battery.DeleteLabelValues(label)
+			f.voltage.DeleteLabelValues(label)
+			f.channelUtil.DeleteLabelValues(label)
+			f.airUtilTx.DeleteLabelValues(label)
+		}
+	}
+	return len(f.heard)
+}
+
+// DeviceMetrics keeps the node's latest battery, voltage and utilization.
+// It holds the lock so heardSince can't delete the node's series halfway through
+func (f *Feed) DeviceMetrics(node uint32, dm *meshtastic.DeviceMetrics) {
+	if f == nil || dm == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	label := nodeLabel(node)
+	if dm.BatteryLevel != nil {
+		f.battery.WithLabelValues(label).Set(float64(*dm.BatteryLevel))
+	}
+	if dm.Voltage != nil {
+		f.voltage.WithLabelValues(label).Set(float64(*dm.Voltage))
+	}
+	if dm.ChannelUtilization != nil {
+		f.channelUtil.WithLabelValues(label).Set(float64(*dm.ChannelUtilization))
+	}
+	if dm.AirUtilTx != nil {
+		f.airUtilTx.WithLabelValues(label).Set(float64(*dm.AirUtilTx))
+	}
+}
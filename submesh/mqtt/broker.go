@@ -0,0 +1,207 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+)
+
+// Broker is one MQTT server to subscribe to
+type Broker struct {
+	Name string `mapstructure:"name"`
+	// Scheme is mqtt, mqtts, ws or wss
+	Scheme string `mapstructure:"scheme"`
+	Host   string `mapstructure:"host"`
+	Port   int    `mapstructure:"port"`
+	// Path is the websocket endpoint, e.g. /mqtt
+	Path     string     `mapstructure:"path"`
+	TLS      *TLSConfig `mapstructure:"tls"`
+	Username string     `mapstructure:"username"`
+	Password string     `mapstructure:"password"`
+	ClientID string     `mapstructure:"client_id"`
+	Topics   []string   `mapstructure:"topics"`
+}
+
+// DefaultBrokerName is used for the broker described directly under mqtt
+const DefaultBrokerName = "default"
+
+// BrokersFromViper reads mqtt.brokers, or the single broker given by mqtt.host and friends
+func BrokersFromViper() ([]Broker, error) {
+	var brokers []Broker
+	if err := viper.UnmarshalKey("mqtt.brokers", &brokers); err != nil {
+		return nil, err
+	}
+	if len(brokers) == 0 {
+		broker := Broker{
+			Name:     DefaultBrokerName,
+			Scheme:   viper.GetString("mqtt.scheme"),
+			Host:     viper.GetString("mqtt.host"),
+			Port:     viper.GetInt("mqtt.port"),
+			Username: viper.GetString("mqtt.username"),
+			Password: viper.GetString("mqtt.password"),
+			ClientID: viper.GetString("mqtt.client_id"),
+			Topics:   viper.GetStringSlice("mqtt.topics"),
+			Path:     viper.GetString("mqtt.path"),
+		}
+		if viper.IsSet("mqtt.tls") {
+			broker.TLS = &TLSConfig{}
+			if err := viper.UnmarshalKey("mqtt.tls", broker.TLS); err != nil {
+				return nil, err
+			}
+		}
+		broker.Defaults()
+		if err := broker.checkScheme(); err != nil {
+			return nil, err
+		}
+		return []Broker{broker}, nil
+	}
+	seen := map[string]bool{}
+	for i := range brokers {
+		if brokers[i].Name == "" || seen[brokers[i].Name] {
+			return nil, fmt.Errorf("broker %d needs a unique name", i)
+		}
+		if brokers[i].Host == "" {
+			return nil, fmt.Errorf("broker %q has no host", brokers[i].Name)
+		}
+		seen[brokers[i].Name] = true
+		brokers[i].Defaults()
+		if err := brokers[i].checkScheme(); err != nil {
+			return nil, err
+		}
+	}
+	return brokers, nil
+}
+
+// Defaults fills in the scheme, its port and a unique client id
+func (b *Broker) Defaults() {
+	if b.Scheme == "" {
+		b.Scheme = "mqtt"
+	}
+	if b.Port == 0 {
+		b.Port = defaultPorts[b.Scheme]
+	}
+	if b.ClientID == "" {
+		b.ClientID = fmt.Sprintf("%s_%s", clientID, uuid.NewString())
+	}
+}
+
+func (b *Broker) URL() *url.URL {
+	u := &url.URL{Scheme: b.Scheme, Host: fmt.Sprintf("%s:%d", b.Host, b.Port)}
+	if b.Scheme == "ws" || b.Scheme == "wss" {
+		u.Path = b.Path
+	}
+	if b.Username != "" {
+		u.User = url.UserPassword(b.Username, b.Password)
+	}
+	return u
+}
+
+// BrokerStatus is a point in time view of a broker connection; times are unix seconds
+type BrokerStatus struct {
+	Name           string   `json:"name"`
+	URL            string   `json:"url"`
+	ClientID       string   `json:"client_id"`
+	Topics         []string `json:"topics"`
+	Connected      bool     `json:"connected"`
+	ConnectedSince uint32   `json:"connected_since,omitempty"`
+	Connects       uint64   `json:"connects"`
+	LastError      string   `json:"last_error,omitempty"`
+	LastErrorAt    uint32   `json:"last_error_at,omitempty"`
+	Messages       uint64   `json:"messages"`
+	Duplicates     uint64   `json:"duplicates"`
+	LastMessageAt  uint32   `json:"last_message_at,omitempty"`
+	Published      uint64   `json:"published"`
+}
+
+// Status tracks a broker connection for the web ui
+type Status struct {
+	lock   sync.RWMutex
+	status BrokerStatus
+	// full url, as it shows up in connection errors
+	secret string
+	conn   *autopaho.ConnectionManager
+}
+
+func NewStatus(b Broker) *Status {
+	u := b.URL()
+	secret := u.String()
+	// never show the password
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	return &Status{secret: secret, status: BrokerStatus{
+		Name:     b.Name,
+		URL:      u.String(),
+		ClientID: b.ClientID,
+		Topics:   b.Topics,
+	}}
+}
+
+func (s *Status) up() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Connected = true
+	s.status.ConnectedSince = uint32(time.Now().Unix())
+	s.status.Connects++
+}
+
+func (s *Status) down(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Connected = false
+	s.status.ConnectedSince = 0
+	if err != nil {
+		s.status.LastError = strings.ReplaceAll(err.Error(), s.secret, s.status.URL)
+		s.status.LastErrorAt = uint32(time.Now().Unix())
+	}
+}
+
+// Received counts a message; duplicates already delivered by another broker are counted apart
+func (s *Status) Received(duplicate bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Messages++
+	if duplicate {
+		s.status.Duplicates++
+	}
+	s.status.LastMessageAt = uint32(time.Now().Unix())
+}
+
+func (s *Status) attach(conn *autopaho.ConnectionManager) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.conn = conn
+}
+
+// Publish sends a message over the broker's connection, failing while it is down
+func (s *Status) Publish(ctx context.Context, topic string, payload []byte, qos byte, retain bool) error {
+	s.lock.RLock()
+	conn := s.conn
+	s.lock.RUnlock()
+	if conn == nil {
+		return autopaho.ConnectionDownError
+	}
+	if _, err := conn.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retain, Payload: payload}); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status.Published++
+	return nil
+}
+
+func (s *Status) Snapshot() BrokerStatus {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	snap := s.status
+	snap.Topics = append([]string(nil), s.status.Topics...)
+	return snap
+}
@@ -8,16 +8,24 @@ import (
 
 	"github.com/eclipse/paho.golang/autopaho"
 	"github.com/eclipse/paho.golang/paho"
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
 const clientID = "SubMesh"
 
-func MQTTConnectAndListen(ctx context.Context, topics []string, u *url.URL, handleMessage func(ctx context.Context, msg paho.PublishReceived)) {
-	log := ctx.Value(contextkeys.Logger).(*zap.Logger).With(zap.String("module", "mqtt"))
+// MQTTConnectAndListen subscribes to the broker's topics until ctx is done, keeping status up to date
+func MQTTConnectAndListen(ctx context.Context, broker Broker, status *Status, handleMessage func(ctx context.Context, msg paho.PublishReceived)) {
+	log := ctx.Value(contextkeys.Logger).(*zap.Logger).With(zap.String("module", "mqtt"), zap.String("broker", broker.Name))
+	if err := broker.checkScheme(); err != nil {
+		log.Fatal("bad broker", zap.Error(err))
+	}
+	tlsCfg, err := broker.TLSConfig()
+	if err != nil {
+		log.Fatal("bad broker tls config", zap.Error(err))
+	}
+	u := broker.URL()
 	subOptions := []paho.SubscribeOptions{}
-	for _, topic := range topics {
+	for _, topic := range broker.Topics {
 		subOptions = append(subOptions, paho.SubscribeOptions{
 			Topic: topic,
 			QoS:   1,
@@ -25,6 +33,7 @@ func MQTTConnectAndListen(ctx context.Context, topics []string, u *url.URL, hand
 	}
 	cliCfg := autopaho.ClientConfig{
 		ServerUrls: []*url.URL{u},
+		TlsCfg:     tlsCfg,
 		KeepAlive:  20, // Keepalive message should be sent every 20 seconds
 		// CleanStartOnInitialConnection defaults to false. Setting this to true will clear the session on the first connection.
 		CleanStartOnInitialConnection: false,
@@ -35,6 +44,7 @@ func MQTTConnectAndListen(ctx context.Context, topics []string, u *url.URL, hand
 		SessionExpiryInterval: 60,
 		OnConnectionUp: func(cm *autopaho.ConnectionManager, connAck *paho.Connack) {
 			log.Info("connection up")
+			status.up()
 			// Subscribing in the OnConnectionUp callback is recommended (ensures the subscription is reestablished if
 			// the connection drops)
 			if _, err := cm.Subscribe(context.Background(), &paho.Subscribe{
@@ -46,19 +56,25 @@ func MQTTConnectAndListen(ctx context.Context, topics []string, u *url.URL, hand
 		},
 		OnConnectError: func(err error) {
 			log.Error("error whilst attempting connection", zap.Error(err))
+			status.down(err)
 		},
 		ClientConfig: paho.ClientConfig{
-			ClientID: fmt.Sprintf("%s_%s", clientID, uuid.NewString()),
+			ClientID: broker.ClientID,
 			OnPublishReceived: []func(paho.PublishReceived) (bool, error){func(msg paho.PublishReceived) (bool, error) {
 				handleMessage(ctx, msg)
 				return true, nil
 			}},
-			OnClientError: func(err error) { log.Error("client error", zap.Error(err)) },
+			OnClientError: func(err error) {
+				log.Error("client error", zap.Error(err))
+				status.down(err)
+			},
 			OnServerDisconnect: func(d *paho.Disconnect) {
 				if d.Properties != nil {
 					log.Warn("server requested disconnect", zap.String("reason", d.Properties.ReasonString))
+					status.down(fmt.Errorf("server requested disconnect: %s", d.Properties.ReasonString))
 				} else {
 					log.Warn("server requested disconnect", zap.Int("reason", int(d.ReasonCode)))
+					status.down(fmt.Errorf("server requested disconnect: reason %d", d.ReasonCode))
 				}
 			},
 		},
@@ -77,9 +93,14 @@ func MQTTConnectAndListen(ctx context.Context, topics []string, u *url.URL, hand
 	if err != nil {
 		log.Fatal("failed to create connection", zap.Error(err))
 	}
+	status.attach(c)
 
 	// Wait for the connection to come up
 	if err = c.AwaitConnection(ctx); err != nil {
+		if ctx.Err() != nil {
+			// shutting down before the broker ever answered
+			return
+		}
 		log.Fatal("failed to connect", zap.Error(err))
 	}
 
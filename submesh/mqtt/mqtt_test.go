@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"submesh/submesh/contextkeys"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const testPayload = "hello over tls"
+
+// serveMQTT is enough of an MQTT 5 broker for one client: it accepts the CONNECT, grants every
+// subscription and publishes a message on the first topic, passing on what the client connected with
+func serveMQTT(conn io.ReadWriter, connects chan<- *packets.Connect) {
+	cp, err := packets.ReadPacket(conn)
+	if err != nil || cp.Type != packets.CONNECT {
+		return
+	}
+	connects <- cp.Content.(*packets.Connect)
+	connack := &packets.Connack{ReasonCode: packets.ConnackSuccess, Properties: &packets.Properties{}}
+	if _, err := connack.WriteTo(conn); err != nil {
+		return
+	}
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Subscribe:
+			suback := &packets.Suback{PacketID: p.PacketID, Reasons: make([]byte, len(p.Subscriptions)), Properties: &packets.Properties{}}
+			if _, err := suback.WriteTo(conn); err != nil {
+				return
+			}
+			publish := &packets.Publish{Topic: p.Subscriptions[0].Topic, Payload: []byte(testPayload), Properties: &packets.Properties{}}
+			if _, err := publish.WriteTo(conn); err != nil {
+				return
+			}
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+// wsConn reads and writes MQTT over websocket binary messages, as autopaho sends them
+type wsConn struct {
+	*websocket.Conn
+	r io.Reader
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			var err error
+			if _, c.r, err = c.NextReader(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// connectAndListen runs MQTTConnectAndListen against b until the first message arrives, returning the CONNECT it sent
+func connectAndListen(t *testing.T, b Broker, connects chan *packets.Connect) *packets.Connect {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextkeys.Logger, zap.NewNop()))
+	status := NewStatus(b)
+	messages := make(chan paho.PublishReceived, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MQTTConnectAndListen(ctx, b, status, func(ctx context.Context, msg paho.PublishReceived) {
+			select {
+			case messages <- msg:
+			default:
+			}
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var connect *packets.Connect
+	select {
+	case connect = <-connects:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no CONNECT reached the broker: %+v", status.Snapshot())
+	}
+	select {
+	case msg := <-messages:
+		if msg.Packet.Topic != b.Topics[0] || string(msg.Packet.Payload) != testPayload {
+			t.Errorf("got %q on %s, want %q on %s", msg.Packet.Payload, msg.Packet.Topic, testPayload, b.Topics[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message after subscribing")
+	}
+	if snap := status.Snapshot(); !snap.Connected || snap.Connects != 1 {
+		t.Errorf("got status %+v, want connected once", snap)
+	}
+	return connect
+}
+
+// TestConnectMQTTS goes through the client config a broker builds: the CA, a client certificate and credentials
+func TestConnectMQTTS(t *testing.T) {
+	p := newTestPKI(t)
+	connects := make(chan *packets.Connect, 1)
+	host, port := listen(t, &tls.Config{
+		Certificates: []tls.Certificate{p.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.pool,
+	}, func(conn net.Conn) { serveMQTT(conn, connects) })
+
+	b := Broker{
+		Name:     "test",
+		Scheme:   "mqtts",
+		Host:     host,
+		Port:     port,
+		Username: "me",
+		Password: "secret",
+		ClientID: "submesh-test",
+		Topics:   []string{"msh/US/#"},
+		TLS:      &TLSConfig{CA: p.caFile, Cert: p.clientCert, Key: p.clientKey},
+	}
+	connect := connectAndListen(t, b, connects)
+	if connect.ClientID != "submesh-test" || connect.Username != "me" || string(connect.Password) != "secret" {
+		t.Errorf("connected as %q with %q/%q, want submesh-test with me/secret", connect.ClientID, connect.Username, connect.Password)
+	}
+}
+
+// TestConnectWSS is the same over a websocket on the broker's path
+func TestConnectWSS(t *testing.T) {
+	p := newTestPKI(t)
+	connects := make(chan *packets.Connect, 1)
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mqtt", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serveMQTT(&wsConn{Conn: conn}, connects)
+	})
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{p.server}}
+	server.StartTLS()
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	b := Broker{
+		Name:     "test",
+		Scheme:   "wss",
+		Host:     addr.IP.String(),
+		Port:     addr.Port,
+		Path:     "/mqtt",
+		ClientID: "submesh-test",
+		Topics:   []string{"msh/EU/#"},
+		TLS:      &TLSConfig{CA: p.caFile},
+	}
+	if connect := connectAndListen(t, b, connects); connect.ClientID != "submesh-test" {
+		t.Errorf("connected as %q, want submesh-test", connect.ClientID)
+	}
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig points at the certificates for mqtts and wss brokers
+type TLSConfig struct {
+	// CA is a PEM bundle to verify the broker with instead of the system roots
+	CA string `mapstructure:"ca"`
+	// Cert and Key are a PEM client certificate and key for mutual TLS
+	Cert               string `mapstructure:"cert"`
+	Key                string `mapstructure:"key"`
+	ServerName         string `mapstructure:"server_name"`
+	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+}
+
+// defaultPorts doubles as the list of supported schemes
+var defaultPorts = map[string]int{
+	"mqtt":  1883,
+	"mqtts": 8883,
+	"ws":    80,
+	"wss":   443,
+}
+
+// Secure reports whether the broker is reached over TLS
+func (b *Broker) Secure() bool {
+	return b.Scheme == "mqtts" || b.Scheme == "wss"
+}
+
+func (b *Broker) checkScheme() error {
+	if _, ok := defaultPorts[b.Scheme]; !ok {
+		return fmt.Errorf("broker %q has unsupported scheme %q, use mqtt, mqtts, ws or wss", b.Name, b.Scheme)
+	}
+	return nil
+}
+
+// TLSConfig loads the CA bundle and client certificate; nil for plain connections
+func (b *Broker) TLSConfig() (*tls.Config, error) {
+	if !b.Secure() {
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: b.Host}
+	if b.TLS == nil {
+		return cfg, nil
+	}
+	if b.TLS.ServerName != "" {
+		cfg.ServerName = b.TLS.ServerName
+	}
+	cfg.InsecureSkipVerify = b.TLS.InsecureSkipVerify
+	if b.TLS.CA != "" {
+		pem, err := os.ReadFile(b.TLS.CA)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in ca %s", b.TLS.CA)
+		}
+	}
+	if b.TLS.Cert != "" || b.TLS.Key != "" {
+		cert, err := tls.LoadX509KeyPair(b.TLS.Cert, b.TLS.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"submesh/submesh/keyring"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Decoded is the part of handling a payload that doesn't touch state: unmarshalling the envelope, decrypting the packet
+// and unmarshalling its payload by portnum. Catchup works these out on several goroutines before storing them in order
+type Decoded struct {
+	topic   string
+	payload []byte
+	// json payloads are cheap to parse and are left to HandleJSONPayload
+	json bool
+
+	env    meshtastic.ServiceEnvelope
+	envErr error
+	// decrypted is false while decryption waits on state, for a PKI packet whose sender key is only known from its NodeInfo
+	decrypted   bool
+	mp          *meshtastic.Data
+	channelName string
+	pki         bool
+	pkiErr      error
+	decryptErr  error
+	port        portPayload
+}
+
+// portPayload is a Data payload unmarshalled by its portnum
+type portPayload struct {
+	// message is nil for text and ports that aren't unmarshalled
+	message proto.Message
+	summary string
+	err     error
+}
+
+// Decode does the stateless work on a payload with the keys of the state it's headed for
+func Decode(keys *keyring.Keyring, topic string, payload []byte) *Decoded {
+	d := &Decoded{topic: topic, payload: payload}
+	if IsJSONTopic(topic) {
+		d.json = true
+		return d
+	}
+	if d.envErr = proto.Unmarshal(payload, &d.env); d.envErr != nil || d.env.Packet == nil {
+		return d
+	}
+	packet := d.env.Packet
+	if _, ok := packet.GetPayloadVariant().(*meshtastic.MeshPacket_Encrypted); !ok {
+		d.decrypted = true
+		return d
+	}
+	if d.wantsPKI(keys) && len(packet.PublicKey) == 0 {
+		return d
+	}
+	d.decrypt(keys, packet.PublicKey)
+	return d
+}
+
+// wantsPKI is whether the packet may be a direct message to one of our nodes
+func (d *Decoded) wantsPKI(keys *keyring.Keyring) bool {
+	packet := d.env.Packet
+	return keys.PrivateKeyFor(packet.To) != nil && (packet.PkiEncrypted || packet.Channel == 0)
+}
+
+// decrypt tries the destination's private key on PKI packets, then the channel keys, and unmarshals what comes out
+func (d *Decoded) decrypt(keys *keyring.Keyring, senderKey []byte) {
+	d.decrypted = true
+	packet := d.env.Packet
+	if d.wantsPKI(keys) {
+		mp, err := decodePKI(keys.PrivateKeyFor(packet.To), senderKey, packet.Id, packet.From, packet.GetEncrypted())
+		if err == nil {
+			d.mp = mp
+			d.pki = true
+			d.channelName = "PKI"
+			d.port = decodePort(mp)
+			return
+		}
+		d.pkiErr = err
+	}
+	mp, channelKey, err := decrypt(keys, packet)
+	if err != nil {
+		d.decryptErr = err
+		return
+	}
+	d.mp = mp
+	d.channelName = channelKey.Name
+	d.port = decodePort(mp)
+}
+
+func decodePort(mp *meshtastic.Data) portPayload {
+	var message proto.Message
+	switch mp.Portnum {
+	case meshtastic.PortNum_TELEMETRY_APP:
+		message = &meshtastic.Telemetry{}
+	case meshtastic.PortNum_NEIGHBORINFO_APP:
+		message = &meshtastic.NeighborInfo{}
+	case meshtastic.PortNum_NODEINFO_APP:
+		message = &meshtastic.User{}
+	case meshtastic.PortNum_POSITION_APP:
+		message = &meshtastic.Position{}
+	case meshtastic.PortNum_TRACEROUTE_APP:
+		message = &meshtastic.RouteDiscovery{}
+	case meshtastic.PortNum_MAP_REPORT_APP:
+		message = &meshtastic.MapReport{}
+	case meshtastic.PortNum_ROUTING_APP:
+		message = &meshtastic.Routing{}
+	case meshtastic.PortNum_TEXT_MESSAGE_APP:
+		return portPayload{summary: string(mp.Payload)}
+	default:
+		return portPayload{}
+	}
+	if err := proto.Unmarshal(mp.Payload, message); err != nil {
+		return portPayload{err: err}
+	}
+	return portPayload{message: message, summary: protojson.Format(message)}
+}
@@ -0,0 +1,267 @@
+package parser
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/metrics"
+	"submesh/submesh/state"
+	"submesh/submesh/types"
+	"time"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// jsonEnvelope is what the firmware publishes on the msh/.../json/ topics
+type jsonEnvelope struct {
+	Id        uint32          `json:"id"`
+	Channel   uint32          `json:"channel"`
+	From      uint32          `json:"from"`
+	To        uint32          `json:"to"`
+	Type      string          `json:"type"`
+	Sender    string          `json:"sender"`
+	Payload   json.RawMessage `json:"payload"`
+	Rssi      int32           `json:"rssi"`
+	Snr       float32         `json:"snr"`
+	HopStart  uint32          `json:"hop_start"`
+	HopsAway  uint32          `json:"hops_away"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+type jsonText struct {
+	Text string `json:"text"`
+}
+
+type jsonNodeInfo struct {
+	Id        string `json:"id"`
+	LongName  string `json:"longname"`
+	ShortName string `json:"shortname"`
+	Hardware  int32  `json:"hardware"`
+	Role      int32  `json:"role"`
+}
+
+type jsonPosition struct {
+	LatitudeI     *int32  `json:"latitude_i"`
+	LongitudeI    *int32  `json:"longitude_i"`
+	Altitude      *int32  `json:"altitude"`
+	Time          uint32  `json:"time"`
+	PrecisionBits uint32  `json:"precision_bits"`
+	PDOP          uint32  `json:"PDOP"`
+	GroundSpeed   *uint32 `json:"ground_speed"`
+	GroundTrack   *uint32 `json:"ground_track"`
+	SatsInView    uint32  `json:"sats_in_view"`
+}
+
+type jsonTelemetry struct {
+	BatteryLevel       *uint32  `json:"battery_level"`
+	Voltage            *float32 `json:"voltage"`
+	ChannelUtilization *float32 `json:"channel_utilization"`
+	AirUtilTx          *float32 `json:"air_util_tx"`
+	UptimeSeconds      *uint32  `json:"uptime_seconds"`
+	Temperature        *float32 `json:"temperature"`
+	RelativeHumidity   *float32 `json:"relative_humidity"`
+	BarometricPressure *float32 `json:"barometric_pressure"`
+	GasResistance      *float32 `json:"gas_resistance"`
+	Iaq                *uint32  `json:"iaq"`
+}
+
+type jsonNeighbor struct {
+	NodeId uint32  `json:"node_id"`
+	Snr    float32 `json:"snr"`
+}
+
+type jsonNeighborInfo struct {
+	NodeId                    uint32         `json:"node_id"`
+	LastSentById              uint32         `json:"last_sent_by_id"`
+	NodeBroadcastIntervalSecs uint32         `json:"node_broadcast_interval_secs"`
+	Neighbors                 []jsonNeighbor `json:"neighbors"`
+}
+
+type jsonTraceroute struct {
+	Route []uint32 `json:"route"`
+}
+
+// jsonToData converts the typed json payload back into the protobuf the firmware started from
+func jsonToData(env *jsonEnvelope) (*meshtastic.Data, error) {
+	var portnum meshtastic.PortNum
+	var msg proto.Message
+
+	switch env.Type {
+	case "text":
+		var p jsonText
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return nil, err
+		}
+		return &meshtastic.Data{Portnum: meshtastic.PortNum_TEXT_MESSAGE_APP, Payload: []byte(p.Text)}, nil
+	case "nodeinfo":
+		var p jsonNodeInfo
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return nil, err
+		}
+		portnum = meshtastic.PortNum_NODEINFO_APP
+		msg = &meshtastic.User{
+			Id:        p.Id,
+			LongName:  p.LongName,
+			ShortName: p.ShortName,
+			HwModel:   meshtastic.HardwareModel(p.Hardware),
+			Role:      meshtastic.Config_DeviceConfig_Role(p.Role),
+		}
+	case "position":
+		var p jsonPosition
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return nil, err
+		}
+		portnum = meshtastic.PortNum_POSITION_APP
+		msg = &meshtastic.Position{
+			LatitudeI:     p.LatitudeI,
+			LongitudeI:    p.LongitudeI,
+			Altitude:      p.Altitude,
+			Time:          p.Time,
+			PrecisionBits: p.PrecisionBits,
+			PDOP:          p.PDOP,
+			GroundSpeed:   p.GroundSpeed,
+			GroundTrack:   p.GroundTrack,
+			SatsInView:    p.SatsInView,
+		}
+	case "telemetry":
+		var p jsonTelemetry
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return nil, err
+		}
+		portnum = meshtastic.PortNum_TELEMETRY_APP
+		telemetry := &meshtastic.Telemetry{Time: uint32(env.Timestamp)}
+		if p.BatteryLevel != nil || p.ChannelUtilization != nil || p.AirUtilTx != nil || p.UptimeSeconds != nil {
+			telemetry.Variant = &meshtastic.Telemetry_DeviceMetrics{DeviceMetrics: &meshtastic.DeviceMetrics{
+				BatteryLevel:       p.BatteryLevel,
+				Voltage:            p.Voltage,
+				ChannelUtilization: p.ChannelUtilization,
+				AirUtilTx:          p.AirUtilTx,
+				UptimeSeconds:      p.UptimeSeconds,
+			}}
+		} else {
+			telemetry.Variant = &meshtastic.Telemetry_EnvironmentMetrics{EnvironmentMetrics: &meshtastic.EnvironmentMetrics{
+				Temperature:        p.Temperature,
+				RelativeHumidity:   p.RelativeHumidity,
+				BarometricPressure: p.BarometricPressure,
+				GasResistance:      p.GasResistance,
+				Voltage:            p.Voltage,
+				Iaq:                p.Iaq,
+			}}
+		}
+		msg = telemetry
+	case "neighborinfo":
+		var p jsonNeighborInfo
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return nil, err
+		}
+		portnum = meshtastic.PortNum_NEIGHBORINFO_APP
+		info := &meshtastic.NeighborInfo{
+			NodeId:                    p.NodeId,
+			LastSentById:              p.LastSentById,
+			NodeBroadcastIntervalSecs: p.NodeBroadcastIntervalSecs,
+		}
+		for _, n := range p.Neighbors {
+			info.Neighbors = append(info.Neighbors, &meshtastic.Neighbor{NodeId: n.NodeId, Snr: n.Snr})
+		}
+		msg = info
+	case "traceroute":
+		var p jsonTraceroute
+		if err := json.Unmarshal(env.Payload, &p); err != nil {
+			return nil, err
+		}
+		portnum = meshtastic.PortNum_TRACEROUTE_APP
+		msg = &meshtastic.RouteDiscovery{Route: p.Route}
+	default:
+		return nil, fmt.Errorf("unsupported json message type %q", env.Type)
+	}
+
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return &meshtastic.Data{Portnum: portnum, Payload: payload}, nil
+}
+
+func HandleJSONPayload(ctx context.Context, rcvTime time.Time, topic string, payload []byte, catchup bool) {
+	log := ctx.Value(contextkeys.Logger).(*zap.Logger)
+	state := ctx.Value(contextkeys.State).(*state.State)
+	defer state.Handling()()
+	defer state.MarkProcessed(rcvTime)
+
+	live := liveMetrics(ctx, catchup)
+	var env jsonEnvelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		log.Error("error unmarshalling json envelope", zap.Error(err))
+		live.ParseError("json")
+		return
+	}
+
+	mp, err := jsonToData(&env)
+	if err != nil {
+		log.Error("error converting json message", zap.String("type", env.Type), zap.Error(err))
+		live.ParseError("json")
+		return
+	}
+
+	hopLimit := uint32(0)
+	if env.HopStart > env.HopsAway {
+		hopLimit = env.HopStart - env.HopsAway
+	}
+	packet := &meshtastic.MeshPacket{
+		Id:       env.Id,
+		From:     env.From,
+		To:       env.To,
+		Channel:  env.Channel,
+		RxSnr:    env.Snr,
+		RxRssi:   env.Rssi,
+		HopStart: env.HopStart,
+		HopLimit: hopLimit,
+		RxTime:   uint32(env.Timestamp),
+	}
+
+	gatewayId := env.Sender
+	if gatewayId == "" {
+		gatewayId = gatewayFromTopic(topic)
+	}
+	state.Receptions.Add(packet.From, packet.To, packet.Id, types.Reception{
+		GatewayId: gatewayId,
+		Topic:     topic,
+		RxTime:    uint32(rcvTime.Unix()),
+		RxRssi:    packet.RxRssi,
+		RxSnr:     packet.RxSnr,
+		HopLimit:  packet.HopLimit,
+		HopStart:  packet.HopStart,
+	})
+	if fm, ok := ctx.Value(contextkeys.FeedMetrics).(*metrics.Feed); ok {
+		fm.Heard(packet.From, rcvTime)
+	}
+	if state.Dedup.Seen(packet.From, packet.Id, rcvTime, catchup) {
+		return
+	}
+
+	messageSummary := types.ParsedMessage[types.MessageSummary]{
+		Underlying: types.MessageSummary{
+			PortNum:  0,
+			PortName: "unknown",
+			Length:   len(env.Payload),
+			// the gateway already decrypted it for us
+			Encrypted: -1,
+		},
+		From:      packet.From,
+		To:        packet.To,
+		Id:        packet.Id,
+		RxSnr:     packet.RxSnr,
+		RxRssi:    packet.RxRssi,
+		HopLimit:  packet.HopLimit,
+		HopStart:  packet.HopStart,
+		RxTime:    uint32(rcvTime.Unix()),
+		Channel:   packet.Channel,
+		GatewayId: gatewayId,
+	}
+
+	live.Packet(mp.Portnum.String(), channelLabel("", topic), topic)
+	handleData(ctx, rcvTime, packet, mp, decodePort(mp), messageSummary, catchup)
+}
@@ -4,13 +4,15 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"strings"
 	"submesh/submesh/contextkeys"
 	"submesh/submesh/filelog"
+	"submesh/submesh/hub"
+	"submesh/submesh/keyring"
+	"submesh/submesh/metrics"
+	"submesh/submesh/search"
 	"submesh/submesh/state"
 	"submesh/submesh/types"
 	"time"
@@ -18,23 +20,9 @@ import (
 	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
 	"github.com/eclipse/paho.golang/paho"
 	"go.uber.org/zap"
-	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
 )
 
-func generateKey(key string) ([]byte, error) {
-	// Pad the key with '=' characters to ensure it's a valid base64 string
-	padding := (4 - len(key)%4) % 4
-	paddedKey := key + strings.Repeat("=", padding)
-
-	// Replace '-' with '+' and '_' with '/'
-	replacedKey := strings.ReplaceAll(paddedKey, "-", "+")
-	replacedKey = strings.ReplaceAll(replacedKey, "_", "/")
-
-	// Decode the base64-encoded key
-	return base64.StdEncoding.DecodeString(replacedKey)
-}
-
 func generateNonce(packetId uint32, node uint32) []byte {
 	packetNonce := make([]byte, 8)
 	nodeNonce := make([]byte, 8)
@@ -62,41 +50,129 @@ func decode(encryptionKey []byte, encryptedData []byte, nonce []byte) (*meshtast
 	return &message, err
 }
 
-var defaultKey []byte
+// EncryptData is decode in reverse, for packets we send
+func EncryptData(key []byte, packetId uint32, from uint32, data *meshtastic.Data) ([]byte, error) {
+	plaintext, err := proto.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCTR(block, generateNonce(packetId, from)).XORKeyStream(ciphertext, plaintext)
+	return ciphertext, nil
+}
+
+// decrypt tries every candidate key for the packet's channel hash and returns the first that yields a sane payload
+func decrypt(keys *keyring.Keyring, packet *meshtastic.MeshPacket) (*meshtastic.Data, *keyring.ChannelKey, error) {
+	nonce := generateNonce(packet.Id, packet.From)
+	err := fmt.Errorf("no channel keys configured")
+	for _, ch := range keys.Candidates(packet.Channel) {
+		var mp *meshtastic.Data
+		mp, err = decode(ch.Key, packet.GetEncrypted(), nonce)
+		if err != nil {
+			continue
+		}
+		if mp.Portnum == meshtastic.PortNum_UNKNOWN_APP {
+			err = fmt.Errorf("decrypted payload has no portnum")
+			continue
+		}
+		return mp, &ch, nil
+	}
+	return nil, nil, err
+}
+
+// liveMetrics is nil during catchup, so replays aren't counted as traffic again
+func liveMetrics(ctx context.Context, catchup bool) *metrics.Feed {
+	if catchup {
+		return nil
+	}
+	fm, _ := ctx.Value(contextkeys.FeedMetrics).(*metrics.Feed)
+	return fm
+}
+
+// packetRxTime prefers the gateway's receive time, which isn't always filled in
+func packetRxTime(packet *meshtastic.MeshPacket, rcvTime time.Time) uint32 {
+	if packet.RxTime != 0 {
+		return packet.RxTime
+	}
+	return uint32(rcvTime.Unix())
+}
+
+// gatewayFromTopic pulls the "!gateway" suffix off a topic like msh/US/2/e/LongFast/!a1b2c3d4
+func gatewayFromTopic(topic string) string {
+	idx := strings.LastIndex(topic, "/")
+	if idx < 0 || !strings.HasPrefix(topic[idx+1:], "!") {
+		return ""
+	}
+	return topic[idx+1:]
+}
+
+// channelLabel names the channel a packet was uplinked on for metrics: the envelope's channel id, or else the
+// topic segment before the gateway, so every path labels a channel the same way
+func channelLabel(channelId string, topic string) string {
+	if channelId != "" {
+		return channelId
+	}
+	topic = strings.TrimSuffix(topic, "/"+gatewayFromTopic(topic))
+	return topic[strings.LastIndex(topic, "/")+1:]
+}
 
-func hashMessage(msg string) string {
-	h := sha256.New()
-	h.Write([]byte(msg))
-	bs := h.Sum(nil)
-	return fmt.Sprintf("%x\n", bs)
+func HandleRawPayload(ctx context.Context, rcvTime time.Time, topic string, payload []byte, catchup bool) {
+	keys := ctx.Value(contextkeys.Keyring).(*keyring.Keyring)
+	HandleDecoded(ctx, rcvTime, Decode(keys, topic, payload), catchup)
 }
 
-func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, catchup bool) {
+// HandleDecoded stores a payload Decode has already worked on
+func HandleDecoded(ctx context.Context, rcvTime time.Time, d *Decoded, catchup bool) {
+	if d.json {
+		HandleJSONPayload(ctx, rcvTime, d.topic, d.payload, catchup)
+		return
+	}
 	log := ctx.Value(contextkeys.Logger).(*zap.Logger)
 	state := ctx.Value(contextkeys.State).(*state.State)
-	var serviceEnv meshtastic.ServiceEnvelope
+	defer state.Handling()()
+	defer state.MarkProcessed(rcvTime)
 
-	err := proto.Unmarshal(payload, &serviceEnv)
-	if err != nil {
-		log.Error("error unmarshalling service envelope", zap.Error(err))
+	live := liveMetrics(ctx, catchup)
+	if d.envErr != nil {
+		log.Error("error unmarshalling service envelope", zap.Error(d.envErr))
+		live.ParseError("envelope")
 		return
 	}
-	if serviceEnv.Packet == nil {
+	if d.env.Packet == nil {
 		log.Error("service envelope missing packet")
+		live.ParseError("envelope")
 		return
 	}
 
-	nonce := generateNonce(serviceEnv.Packet.Id, serviceEnv.Packet.From)
-	if len(defaultKey) == 0 {
-		key, err := generateKey("1PG7OiApB1nwvP+rz05pAQ==")
-		if err != nil {
-			log.Error("error generating key", zap.Error(err))
-			return
-		}
-		defaultKey = key
+	keys := ctx.Value(contextkeys.Keyring).(*keyring.Keyring)
+	serviceEnv := &d.env
+	topic := d.topic
+
+	gatewayId := serviceEnv.GatewayId
+	if gatewayId == "" {
+		gatewayId = gatewayFromTopic(topic)
+	}
+	state.Receptions.Add(serviceEnv.Packet.From, serviceEnv.Packet.To, serviceEnv.Packet.Id, types.Reception{
+		GatewayId: gatewayId,
+		ChannelId: serviceEnv.ChannelId,
+		Topic:     topic,
+		RxTime:    uint32(rcvTime.Unix()),
+		RxRssi:    serviceEnv.Packet.RxRssi,
+		RxSnr:     serviceEnv.Packet.RxSnr,
+		HopLimit:  serviceEnv.Packet.HopLimit,
+		HopStart:  serviceEnv.Packet.HopStart,
+	})
+	if fm, ok := ctx.Value(contextkeys.FeedMetrics).(*metrics.Feed); ok {
+		fm.Heard(serviceEnv.Packet.From, rcvTime)
+	}
+	if state.Dedup.Seen(serviceEnv.Packet.From, serviceEnv.Packet.Id, rcvTime, catchup) {
+		return
 	}
 
-	var mp *meshtastic.Data
 	messageSummary := types.ParsedMessage[types.MessageSummary]{
 		Underlying: types.MessageSummary{
 			PortNum:  0,
@@ -104,7 +180,9 @@ func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, ca
 		},
 		From:         serviceEnv.Packet.From,
 		To:           serviceEnv.Packet.To,
+		Id:           serviceEnv.Packet.Id,
 		RxSnr:        serviceEnv.Packet.RxSnr,
+		RxRssi:       serviceEnv.Packet.RxRssi,
 		HopLimit:     serviceEnv.Packet.HopLimit,
 		WantAck:      serviceEnv.Packet.WantAck,
 		Priority:     serviceEnv.Packet.Priority,
@@ -113,22 +191,35 @@ func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, ca
 		PkiEncrypted: serviceEnv.Packet.PkiEncrypted,
 		RxTime:       uint32(rcvTime.Unix()),
 		Channel:      serviceEnv.Packet.Channel,
+		GatewayId:    gatewayId,
 	}
 	switch serviceEnv.Packet.GetPayloadVariant().(type) {
 	case *meshtastic.MeshPacket_Encrypted:
 		messageSummary.Underlying.Length = len(serviceEnv.Packet.GetEncrypted())
-		mp, err = decode(defaultKey, serviceEnv.Packet.GetEncrypted(), nonce)
-		if err != nil {
+		if !d.decrypted {
+			// the sender's public key comes from the last NodeInfo we have for it
+			var senderKey []byte
+			if sender := state.Users.LastBy(fmt.Sprintf("%d", serviceEnv.Packet.From)); sender != nil {
+				senderKey = sender.Underlying.PublicKey
+			}
+			d.decrypt(keys, senderKey)
+		}
+		if d.pkiErr != nil {
+			log.Debug("pki decryption failed, trying channel keys", zap.Error(d.pkiErr))
+		}
+		if d.decryptErr != nil {
 			log.Error("error decrypting message",
 				zap.Uint32("from", serviceEnv.Packet.From),
 				zap.Uint32("to", serviceEnv.Packet.To),
 				zap.Uint32("channel", serviceEnv.Packet.Channel),
 				zap.ByteString("msg", serviceEnv.Packet.GetEncrypted()),
+				zap.Error(d.decryptErr),
 			)
 			state.NonDecryptable.Add(
 				types.ParsedMessage[int]{
 					Underlying: len(serviceEnv.Packet.GetEncrypted()),
 					RxTime:     uint32(rcvTime.Unix()),
+					Id:         serviceEnv.Packet.Id,
 					From:       serviceEnv.Packet.From,
 					To:         serviceEnv.Packet.To,
 					Channel:    serviceEnv.Packet.Channel,
@@ -136,9 +227,15 @@ func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, ca
 			)
 			messageSummary.Underlying.Encrypted = 1
 			state.AllMessages.Add(messageSummary)
+			live.DecryptFailure(channelLabel(serviceEnv.ChannelId, topic))
+			live.Packet("ENCRYPTED", channelLabel(serviceEnv.ChannelId, topic), topic)
 			return
 		}
 		messageSummary.Underlying.Encrypted = 0
+		if d.pki {
+			messageSummary.PkiEncrypted = true
+		}
+		messageSummary.ChannelName = d.channelName
 
 	case *meshtastic.MeshPacket_Decoded:
 		break
@@ -150,36 +247,43 @@ func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, ca
 
 	}
 
-	if mp == nil {
+	if d.mp == nil {
 		log.Error("no message payload")
 		return
 	}
 
+	live.Packet(d.mp.Portnum.String(), channelLabel(serviceEnv.ChannelId, topic), topic)
+	handleData(ctx, rcvTime, serviceEnv.Packet, d.mp, d.port, messageSummary, catchup)
+}
+
+// handleData stores a decoded payload by portnum, shared by the protobuf and json feeds
+func handleData(ctx context.Context, rcvTime time.Time, packet *meshtastic.MeshPacket, mp *meshtastic.Data, port portPayload, messageSummary types.ParsedMessage[types.MessageSummary], catchup bool) {
+	log := ctx.Value(contextkeys.Logger).(*zap.Logger)
+	state := ctx.Value(contextkeys.State).(*state.State)
+	index, _ := ctx.Value(contextkeys.Search).(*search.Index)
+	fm, _ := ctx.Value(contextkeys.FeedMetrics).(*metrics.Feed)
+	live := liveMetrics(ctx, catchup)
+
 	messageSummary.Underlying.PortName = mp.Portnum.String()
 	messageSummary.Underlying.PortNum = uint32(mp.Portnum.Number())
 
 	log = log.With(zap.Any("portnum", mp.Portnum))
-	var msgHash string
+	if port.err != nil {
+		log.Error("error unmarshalling", zap.Error(port.err))
+		live.ParseError("payload")
+		return
+	}
+	messageSummary.Underlying.Summary = port.summary
 	switch mp.Portnum {
 	case meshtastic.PortNum_TELEMETRY_APP:
-		var data meshtastic.Telemetry
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling telemetry app", zap.Error(err))
-			return
-		}
-
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
+		data := port.message.(*meshtastic.Telemetry)
 		switch data.GetVariant().(type) {
 		case *meshtastic.Telemetry_AirQualityMetrics:
 			if !catchup {
 				log.Info("received Air Quality telemetry", zap.Any("data", data.GetAirQualityMetrics()))
 			}
 		case *meshtastic.Telemetry_DeviceMetrics:
+			fm.DeviceMetrics(packet.From, data.GetDeviceMetrics())
 			if !catchup {
 				log.Info("received Device Metrics telemetry", zap.Any("data", data.GetDeviceMetrics()))
 			}
@@ -204,156 +308,97 @@ func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, ca
 		}
 		state.Telemetry.Add(
 			types.ParsedMessage[meshtastic.Telemetry]{
-				Underlying: data,
-				RxTime:     uint32(rcvTime.Unix()),
-				From:       serviceEnv.Packet.From,
-				To:         serviceEnv.Packet.To,
-				Channel:    serviceEnv.Packet.Channel,
-			}, fmt.Sprintf("%d", serviceEnv.Packet.From))
+				Underlying:  *data,
+				RxTime:      uint32(rcvTime.Unix()),
+				Id:          packet.Id,
+				From:        packet.From,
+				To:          packet.To,
+				Channel:     packet.Channel,
+				ChannelName: messageSummary.ChannelName,
+			}, fmt.Sprintf("%d", packet.From))
 	case meshtastic.PortNum_NEIGHBORINFO_APP:
-		var data meshtastic.NeighborInfo
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling", zap.Error(err))
-			return
-		}
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
-
+		data := port.message.(*meshtastic.NeighborInfo)
 		if !catchup {
 			log.Info("received message", zap.String("data", data.String()))
 		}
 		state.Neighbors.Add(
 			types.ParsedMessage[meshtastic.NeighborInfo]{
-				Underlying: data,
-				RxTime:     uint32(rcvTime.Unix()),
-				From:       serviceEnv.Packet.From,
-				To:         serviceEnv.Packet.To,
-				Channel:    serviceEnv.Packet.Channel,
+				Underlying:  *data,
+				RxTime:      uint32(rcvTime.Unix()),
+				Id:          packet.Id,
+				From:        packet.From,
+				To:          packet.To,
+				Channel:     packet.Channel,
+				ChannelName: messageSummary.ChannelName,
 			}, fmt.Sprintf("%d", data.NodeId))
 	case meshtastic.PortNum_NODEINFO_APP:
-		var data meshtastic.User
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling", zap.Error(err))
-			return
-		}
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
-
+		data := port.message.(*meshtastic.User)
 		if !catchup {
 			log.Info("received message", zap.String("data", data.String()))
 		}
-		state.Users.Add(
-			types.ParsedMessage[meshtastic.User]{
-				Underlying: data,
-				RxTime:     uint32(rcvTime.Unix()),
-				From:       serviceEnv.Packet.From,
-				To:         serviceEnv.Packet.To,
-				Channel:    serviceEnv.Packet.Channel,
-			},
-			fmt.Sprintf("%d", serviceEnv.Packet.From), data.Id, data.ShortName)
-	case meshtastic.PortNum_POSITION_APP:
-		var data meshtastic.Position
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling", zap.Error(err))
-			return
+		user := types.ParsedMessage[meshtastic.User]{
+			Underlying:  *data,
+			RxTime:      uint32(rcvTime.Unix()),
+			Id:          packet.Id,
+			From:        packet.From,
+			To:          packet.To,
+			Channel:     packet.Channel,
+			ChannelName: messageSummary.ChannelName,
 		}
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
-
+		state.Users.Add(user, fmt.Sprintf("%d", packet.From), data.Id, data.ShortName)
+		index.AddNode(&user)
+	case meshtastic.PortNum_POSITION_APP:
+		data := port.message.(*meshtastic.Position)
 		if !catchup {
 			log.Info("received message", zap.String("data", data.String()))
 		}
 		state.Positions.Add(
 			types.ParsedMessage[meshtastic.Position]{
-				Underlying: data,
-				RxTime:     uint32(rcvTime.Unix()),
-				From:       serviceEnv.Packet.From,
-				To:         serviceEnv.Packet.To,
-				Channel:    serviceEnv.Packet.Channel,
-			}, fmt.Sprintf("%d", serviceEnv.Packet.From))
+				Underlying:  *data,
+				RxTime:      uint32(rcvTime.Unix()),
+				Id:          packet.Id,
+				From:        packet.From,
+				To:          packet.To,
+				Channel:     packet.Channel,
+				ChannelName: messageSummary.ChannelName,
+			}, fmt.Sprintf("%d", packet.From))
 	case meshtastic.PortNum_TEXT_MESSAGE_APP:
 		if !catchup {
 			log.Info("received text message", zap.String("data", string(mp.Payload)))
 		}
-		messageSummary.Underlying.Summary = string(mp.Payload)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
+		chat := types.ParsedMessage[string]{
+			Underlying:  string(mp.Payload),
+			RxTime:      packetRxTime(packet, rcvTime),
+			Id:          packet.Id,
+			From:        packet.From,
+			To:          packet.To,
+			Channel:     packet.Channel,
+			ChannelName: messageSummary.ChannelName,
 		}
-
-		state.Chats.Add(
-			types.ParsedMessage[string]{
-				Underlying: string(mp.Payload),
-				RxTime:     serviceEnv.Packet.RxTime,
-				From:       serviceEnv.Packet.From,
-				To:         serviceEnv.Packet.To,
-				Channel:    serviceEnv.Packet.Channel,
-			}, "last")
+		state.Chats.Add(chat, "last")
+		index.AddChat(&chat)
 	case meshtastic.PortNum_TRACEROUTE_APP:
-		var data meshtastic.RouteDiscovery
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling", zap.Error(err))
-			return
-		}
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
-
+		data := port.message.(*meshtastic.RouteDiscovery)
 		if !catchup {
 			log.Info("received message", zap.String("data", data.String()))
 		}
 		state.Traceroutes.Add(
 			types.ParsedMessage[meshtastic.RouteDiscovery]{
-				Underlying: data,
-				RxTime:     serviceEnv.Packet.RxTime,
-				From:       serviceEnv.Packet.From,
-				To:         serviceEnv.Packet.To,
-				Channel:    serviceEnv.Packet.Channel,
-			}, fmt.Sprintf("%d", serviceEnv.Packet.From))
+				Underlying:  *data,
+				RxTime:      packetRxTime(packet, rcvTime),
+				Id:          packet.Id,
+				From:        packet.From,
+				To:          packet.To,
+				Channel:     packet.Channel,
+				ChannelName: messageSummary.ChannelName,
+			}, fmt.Sprintf("%d", packet.From))
 	case meshtastic.PortNum_MAP_REPORT_APP:
-		var data meshtastic.MapReport
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling", zap.Error(err))
-			return
-		}
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
-
+		data := port.message.(*meshtastic.MapReport)
 		if !catchup {
 			log.Info("received message", zap.String("data", data.String()))
 		}
 	case meshtastic.PortNum_ROUTING_APP:
-		var data meshtastic.Routing
-		err = proto.Unmarshal(mp.Payload, &data)
-		if err != nil {
-			log.Error("error unmarshalling", zap.Error(err))
-			return
-		}
-		messageSummary.Underlying.Summary = protojson.Format(&data)
-		msgHash = hashMessage(messageSummary.Underlying.Summary)
-		if _, ok := state.ProcessedHash[msgHash]; ok {
-			return
-		}
-
+		data := port.message.(*meshtastic.Routing)
 		if !catchup {
 			log.Info("received message", zap.String("data", data.String()))
 		}
@@ -361,20 +406,38 @@ func HandleRawPayload(ctx context.Context, rcvTime time.Time, payload []byte, ca
 		log.Error("unknown port number")
 	}
 	state.AllMessages.Add(messageSummary)
-	state.ProcessedHash[msgHash] = time.Now()
-}
-func HandleMQTTMessage(ctx context.Context, pr paho.PublishReceived) {
+	index.AddMessage(&messageSummary)
 
-	log := ctx.Value(contextkeys.Logger).(*zap.Logger).With(zap.String("module", "parser"), zap.String("topic", pr.Packet.Topic))
-	if strings.Contains(pr.Packet.Topic, "/json/") {
-		// json log
-		log.Info("received json message")
-		return
+	if liveHub, ok := ctx.Value(contextkeys.Hub).(*hub.Hub); ok && !catchup {
+		liveHub.Publish(messageSummary)
 	}
-	// save to bytelog
-	ctx.Value(contextkeys.RAWFileLogger).(*filelog.FileLog).Write(
+}
+
+// IsJSONTopic reports whether a topic carries the firmware's json envelopes rather than protobufs
+func IsJSONTopic(topic string) bool {
+	return strings.Contains(topic, "/json/")
+}
+
+// HandleMQTTMessage logs a message to the feed's bytelog and handles it as captured there, so the high-water mark
+// lines up with the log entry. It returns the capture time
+func HandleMQTTMessage(ctx context.Context, pr paho.PublishReceived) time.Time {
+	rcvTime, err := ctx.Value(contextkeys.RAWFileLogger).(*filelog.FileLog).Write(
 		pr.Packet.Topic, pr.Packet.Payload,
 	)
+	if err != nil {
+		log := ctx.Value(contextkeys.Logger).(*zap.Logger)
+		log.Error("error writing to bytelog", zap.String("topic", pr.Packet.Topic), zap.Error(err))
+	}
+
+	HandlePayload(ctx, rcvTime, pr.Packet.Topic, pr.Packet.Payload, false)
+	return rcvTime
+}
 
-	HandleRawPayload(ctx, time.Now(), pr.Packet.Payload, false)
+// HandlePayload picks the json or protobuf handler by topic
+func HandlePayload(ctx context.Context, rcvTime time.Time, topic string, payload []byte, catchup bool) {
+	if IsJSONTopic(topic) {
+		HandleJSONPayload(ctx, rcvTime, topic, payload, catchup)
+		return
+	}
+	HandleRawPayload(ctx, rcvTime, topic, payload, catchup)
 }
@@ -0,0 +1,111 @@
+package parser
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	pkiTagSize        = 8
+	pkiExtraNonceSize = 4
+	// 15 - L, with the firmware's L of 2
+	ccmNonceSize = 13
+)
+
+// generatePKINonce mirrors CryptoEngine::initNonce, where the extra nonce overwrites the top half of the packet id
+func generatePKINonce(packetId uint32, node uint32, extraNonce []byte) []byte {
+	nonce := make([]byte, 16)
+	binary.LittleEndian.PutUint64(nonce, uint64(packetId))
+	binary.LittleEndian.PutUint32(nonce[8:], node)
+	copy(nonce[4:8], extraNonce)
+	return nonce[:ccmNonceSize]
+}
+
+// ccmOpen is AES-CCM (RFC 3610) decryption without associated data
+func ccmOpen(block cipher.Block, nonce []byte, ciphertext []byte, tag []byte) ([]byte, error) {
+	l := 15 - len(nonce)
+	if l < 2 || len(ciphertext) >= 1<<(8*l) {
+		return nil, fmt.Errorf("ccm: invalid nonce or message length")
+	}
+
+	counter := make([]byte, aes.BlockSize)
+	counter[0] = byte(l - 1)
+	copy(counter[1:], nonce)
+	s0 := make([]byte, aes.BlockSize)
+	block.Encrypt(s0, counter)
+
+	// counter blocks start at 1 for the payload
+	plaintext := make([]byte, len(ciphertext))
+	keystream := make([]byte, aes.BlockSize)
+	for i := 0; i < len(ciphertext); i += aes.BlockSize {
+		ctr := uint64(i/aes.BlockSize + 1)
+		for j := 0; j < l; j++ {
+			counter[15-j] = byte(ctr >> (8 * j))
+		}
+		block.Encrypt(keystream, counter)
+		end := min(i+aes.BlockSize, len(ciphertext))
+		subtle.XORBytes(plaintext[i:end], ciphertext[i:end], keystream)
+	}
+
+	// CBC-MAC over B_0 and the padded plaintext
+	mac := make([]byte, aes.BlockSize)
+	mac[0] = byte(((len(tag)-2)/2)<<3 | (l - 1))
+	copy(mac[1:], nonce)
+	for j := 0; j < l; j++ {
+		mac[15-j] = byte(len(plaintext) >> (8 * j))
+	}
+	block.Encrypt(mac, mac)
+	for i := 0; i < len(plaintext); i += aes.BlockSize {
+		end := min(i+aes.BlockSize, len(plaintext))
+		subtle.XORBytes(mac, mac, plaintext[i:end])
+		block.Encrypt(mac, mac)
+	}
+	subtle.XORBytes(mac, mac, s0)
+
+	if subtle.ConstantTimeCompare(mac[:len(tag)], tag) != 1 {
+		return nil, fmt.Errorf("ccm: message authentication failed")
+	}
+	return plaintext, nil
+}
+
+// decodePKI performs meshtastic's curve25519 direct message decryption:
+// ECDH between our private key and the sender's public key, hashed with SHA256, then AES-CCM
+func decodePKI(privateKey *ecdh.PrivateKey, senderPublicKey []byte, packetId uint32, from uint32, encryptedData []byte) (*meshtastic.Data, error) {
+	if len(encryptedData) < pkiTagSize+pkiExtraNonceSize {
+		return nil, fmt.Errorf("pki payload too short: %d bytes", len(encryptedData))
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(senderPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256(shared)
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	ciphertextLen := len(encryptedData) - pkiTagSize - pkiExtraNonceSize
+	tag := encryptedData[ciphertextLen : ciphertextLen+pkiTagSize]
+	extraNonce := encryptedData[ciphertextLen+pkiTagSize:]
+
+	plaintext, err := ccmOpen(block, generatePKINonce(packetId, from, extraNonce), encryptedData[:ciphertextLen], tag)
+	if err != nil {
+		return nil, err
+	}
+
+	var message meshtastic.Data
+	err = proto.Unmarshal(plaintext, &message)
+	return &message, err
+}
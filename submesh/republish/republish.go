@@ -0,0 +1,159 @@
+package republish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/hub"
+	"submesh/submesh/keyring"
+	"submesh/submesh/mqtt"
+	"submesh/submesh/types"
+	"sync/atomic"
+	"time"
+
+	meshtastic "buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"go.uber.org/zap"
+)
+
+// DefaultTopic is used when mqtt.republish.topic is empty
+const DefaultTopic = "submesh/decoded/{portname}/{from}"
+
+const publishTimeout = 10 * time.Second
+
+// DefaultQueue is how many packets may wait while a publish is slow or the broker is down
+const DefaultQueue = 1024
+
+// dropReportInterval is how often packets dropped off a full queue are logged
+const dropReportInterval = time.Minute
+
+// Document is the decoded packet as other tools see it
+type Document struct {
+	Id          uint32  `json:"id"`
+	RxTime      uint32  `json:"rx_time"`
+	From        uint32  `json:"from"`
+	FromHex     string  `json:"from_hex"`
+	To          uint32  `json:"to"`
+	ToHex       string  `json:"to_hex"`
+	Channel     uint32  `json:"channel"`
+	ChannelName string  `json:"channel_name,omitempty"`
+	GatewayId   string  `json:"gateway_id,omitempty"`
+	RxSnr       float32 `json:"rx_snr"`
+	RxRssi      int32   `json:"rx_rssi"`
+	HopLimit    uint32  `json:"hop_limit"`
+	HopStart    uint32  `json:"hop_start"`
+	PortNum     uint32  `json:"port_num"`
+	PortName    string  `json:"port_name"`
+	// Payload is the decoded protobuf as json, or a string for text messages
+	Payload json.RawMessage `json:"payload"`
+}
+
+func NewDocument(m *types.ParsedMessage[types.MessageSummary]) Document {
+	// summaries are protojson, except for text which stays a string even when it looks like json
+	payload := json.RawMessage(m.Underlying.Summary)
+	if m.Underlying.PortNum == uint32(meshtastic.PortNum_TEXT_MESSAGE_APP) || !json.Valid(payload) {
+		payload, _ = json.Marshal(m.Underlying.Summary)
+	}
+	return Document{
+		Id:          m.Id,
+		RxTime:      m.RxTime,
+		From:        m.From,
+		FromHex:     keyring.FormatNodeId(m.From),
+		To:          m.To,
+		ToHex:       keyring.FormatNodeId(m.To),
+		Channel:     m.Channel,
+		ChannelName: m.ChannelName,
+		GatewayId:   m.GatewayId,
+		RxSnr:       m.RxSnr,
+		RxRssi:      m.RxRssi,
+		HopLimit:    m.HopLimit,
+		HopStart:    m.HopStart,
+		PortNum:     m.Underlying.PortNum,
+		PortName:    m.Underlying.PortName,
+		Payload:     payload,
+	}
+}
+
+// topicSafe keeps a value to a single topic level without wildcards
+var topicSafe = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// Topic fills in {portname}, {portnum}, {from}, {to}, {channel} and {gateway}
+func Topic(template string, d *Document) string {
+	channel := d.ChannelName
+	if channel == "" {
+		channel = fmt.Sprintf("%d", d.Channel)
+	}
+	return strings.NewReplacer(
+		"{portname}", topicSafe.Replace(d.PortName),
+		"{portnum}", fmt.Sprintf("%d", d.PortNum),
+		"{from}", d.FromHex,
+		"{to}", d.ToHex,
+		"{channel}", topicSafe.Replace(channel),
+		"{gateway}", topicSafe.Replace(d.GatewayId),
+	).Replace(template)
+}
+
+// Republisher sends every live packet of a hub to a broker as json
+type Republisher struct {
+	Template string
+	QoS      byte
+	Retain   bool
+	// Queue is how many packets are held for publishing before new ones are dropped
+	Queue  int
+	broker *mqtt.Status
+	sub    atomic.Pointer[hub.Subscription]
+}
+
+func NewRepublisher(broker *mqtt.Status, template string) *Republisher {
+	if template == "" {
+		template = DefaultTopic
+	}
+	return &Republisher{Template: template, Queue: DefaultQueue, broker: broker}
+}
+
+// Dropped is how many packets were never published because the queue was full
+func (r *Republisher) Dropped() uint64 {
+	if sub := r.sub.Load(); sub != nil {
+		return sub.Dropped()
+	}
+	return 0
+}
+
+// Run publishes until ctx is done; the hub only carries packets that made it past dedup
+func (r *Republisher) Run(ctx context.Context, from *hub.Hub) {
+	log := ctx.Value(contextkeys.Logger).(*zap.Logger).With(zap.String("module", "republish"))
+	sub := from.SubscribeBuffered(hub.Filter{}, r.Queue)
+	r.sub.Store(sub)
+	defer sub.Close()
+	report := time.NewTicker(dropReportInterval)
+	defer report.Stop()
+	var reported uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-report.C:
+			if dropped := sub.Dropped(); dropped > reported {
+				log.Warn("republish queue full, packets dropped", zap.Uint64("dropped", dropped-reported), zap.Uint64("total", dropped))
+				reported = dropped
+			}
+		case m, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			doc := NewDocument(&m)
+			payload, err := json.Marshal(doc)
+			if err != nil {
+				log.Error("error marshalling document", zap.Error(err))
+				continue
+			}
+			pubCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+			err = r.broker.Publish(pubCtx, Topic(r.Template, &doc), payload, r.QoS, r.Retain)
+			cancel()
+			if err != nil {
+				log.Warn("error republishing", zap.Uint32("id", doc.Id), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package search
+
+import (
+	"strings"
+	"submesh/submesh/state"
+	"submesh/submesh/types"
+	"sync"
+	"unicode"
+
+	"buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+)
+
+type Kind string
+
+const (
+	KindChat    Kind = "chat"
+	KindNode    Kind = "node"
+	KindMessage Kind = "message"
+)
+
+const defaultLimit = 50000
+
+// Document is one searchable item; node documents are replaced as nodes send new info
+type Document struct {
+	Kind        Kind
+	RxTime      uint32
+	Id          uint32
+	From        uint32
+	To          uint32
+	ChannelName string
+	PortName    string
+	Text        string
+}
+
+type document struct {
+	Document
+	// positions of each term in Text, used for phrases and term frequency
+	terms  map[string][]int
+	length int
+}
+
+// Index is an in-memory inverted index over chats, node names and message summaries.
+// Chats and messages beyond Limit are evicted oldest first; nodes are always kept.
+type Index struct {
+	lock     sync.RWMutex
+	docs     map[uint64]*document
+	postings map[string]map[uint64]struct{}
+	nodes    map[uint32]uint64
+	// order holds the evictable documents, oldest first
+	order     []uint64
+	next      uint64
+	totalTerm int
+	Limit     int
+}
+
+func NewIndex() *Index {
+	return &Index{
+		docs:     make(map[uint64]*document),
+		postings: make(map[string]map[uint64]struct{}),
+		nodes:    make(map[uint32]uint64),
+		Limit:    defaultLimit,
+	}
+}
+
+// tokenize lowercases and splits on anything that isn't a letter or digit
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add indexes a document; the caller holds the write lock
+func (idx *Index) add(d Document) uint64 {
+	id := idx.next
+	idx.next++
+	tokens := tokenize(d.Text)
+	doc := &document{Document: d, terms: make(map[string][]int), length: len(tokens)}
+	for pos, term := range tokens {
+		doc.terms[term] = append(doc.terms[term], pos)
+	}
+	for term := range doc.terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[uint64]struct{})
+		}
+		idx.postings[term][id] = struct{}{}
+	}
+	idx.docs[id] = doc
+	idx.totalTerm += doc.length
+	return id
+}
+
+// remove drops a document and its postings; the caller holds the write lock
+func (idx *Index) remove(id uint64) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.totalTerm -= doc.length
+	delete(idx.docs, id)
+}
+
+func (idx *Index) addEvictable(d Document) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.order = append(idx.order, idx.add(d))
+	for idx.Limit > 0 && len(idx.order) > idx.Limit {
+		idx.remove(idx.order[0])
+		idx.order = idx.order[1:]
+	}
+}
+
+// AddChat indexes a text message; a nil index ignores it
+func (idx *Index) AddChat(m *types.ParsedMessage[string]) {
+	if idx == nil {
+		return
+	}
+	idx.addEvictable(Document{
+		Kind:        KindChat,
+		RxTime:      m.RxTime,
+		Id:          m.Id,
+		From:        m.From,
+		To:          m.To,
+		ChannelName: m.ChannelName,
+		PortName:    meshtastic.PortNum_TEXT_MESSAGE_APP.String(),
+		Text:        m.Underlying,
+	})
+}
+
+// AddMessage indexes a packet summary; text messages are left to AddChat
+func (idx *Index) AddMessage(m *types.ParsedMessage[types.MessageSummary]) {
+	if idx == nil || m.Underlying.Summary == "" || m.Underlying.PortNum == uint32(meshtastic.PortNum_TEXT_MESSAGE_APP) {
+		return
+	}
+	idx.addEvictable(Document{
+		Kind:        KindMessage,
+		RxTime:      m.RxTime,
+		Id:          m.Id,
+		From:        m.From,
+		To:          m.To,
+		ChannelName: m.ChannelName,
+		PortName:    m.Underlying.PortName,
+		Text:        m.Underlying.Summary,
+	})
+}
+
+// AddNode indexes a node's names and id, replacing what was indexed for it before
+func (idx *Index) AddNode(m *types.ParsedMessage[meshtastic.User]) {
+	if idx == nil {
+		return
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, ok := idx.nodes[m.From]; ok {
+		idx.remove(old)
+	}
+	idx.nodes[m.From] = idx.add(Document{
+		Kind:        KindNode,
+		RxTime:      m.RxTime,
+		Id:          m.Id,
+		From:        m.From,
+		To:          m.To,
+		ChannelName: m.ChannelName,
+		PortName:    meshtastic.PortNum_NODEINFO_APP.String(),
+		Text:        strings.Join([]string{m.Underlying.LongName, m.Underlying.ShortName, m.Underlying.Id}, " "),
+	})
+}
+
+// Len is how many documents are indexed
+func (idx *Index) Len() int {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return len(idx.docs)
+}
+
+// Seed indexes what a state already holds, for when it was loaded from a store rather than replayed
+func (idx *Index) Seed(s *state.State) {
+	chats := s.Chats.All()
+	for i := len(chats) - 1; i >= 0; i-- {
+		idx.AddChat(&chats[i])
+	}
+	users := s.Users.All()
+	for i := len(users) - 1; i >= 0; i-- {
+		idx.AddNode(&users[i])
+	}
+	messages := s.AllMessages.All()
+	for i := len(messages) - 1; i >= 0; i-- {
+		idx.AddMessage(&messages[i])
+	}
+}
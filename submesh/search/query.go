@@ -0,0 +1,216 @@
+package search
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// BM25 tuning
+const (
+	k1 = 1.2
+	b  = 0.75
+
+	snippetBefore = 60
+	snippetAfter  = 120
+)
+
+// Query matches documents holding every term; text in double quotes must appear as a phrase
+type Query struct {
+	Text  string
+	Kinds []Kind
+	// Node matches documents sent by or to it; 0 matches any
+	Node uint32
+	// zero times leave that end open
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+type Result struct {
+	Document
+	Score   float64
+	Snippet string
+}
+
+type parsedQuery struct {
+	terms   []string
+	phrases [][]string
+}
+
+func parse(text string) parsedQuery {
+	var q parsedQuery
+	// every odd part sits between a pair of quotes
+	for i, part := range strings.Split(text, `"`) {
+		tokens := tokenize(part)
+		if i%2 == 1 && len(tokens) > 1 {
+			q.phrases = append(q.phrases, tokens)
+		}
+		for _, t := range tokens {
+			if !slices.Contains(q.terms, t) {
+				q.terms = append(q.terms, t)
+			}
+		}
+	}
+	return q
+}
+
+func (d *document) hasPhrase(phrase []string) bool {
+	for _, start := range d.terms[phrase[0]] {
+		matched := true
+		for i := 1; i < len(phrase); i++ {
+			if _, found := slices.BinarySearch(d.terms[phrase[i]], start+i); !found {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Query) accepts(d *document) bool {
+	if len(q.Kinds) > 0 && !slices.Contains(q.Kinds, d.Kind) {
+		return false
+	}
+	if q.Node != 0 && d.From != q.Node && d.To != q.Node {
+		return false
+	}
+	if !q.Since.IsZero() && int64(d.RxTime) < q.Since.Unix() {
+		return false
+	}
+	if !q.Until.IsZero() && int64(d.RxTime) >= q.Until.Unix() {
+		return false
+	}
+	return true
+}
+
+// candidates intersects the postings of every term, starting from the rarest; the caller holds the lock
+func (idx *Index) candidates(terms []string) []uint64 {
+	if len(terms) == 0 {
+		ids := make([]uint64, 0, len(idx.docs))
+		for id := range idx.docs {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	sets := make([]map[uint64]struct{}, 0, len(terms))
+	for _, term := range terms {
+		set, ok := idx.postings[term]
+		if !ok {
+			return nil
+		}
+		sets = append(sets, set)
+	}
+	slices.SortFunc(sets, func(a, b map[uint64]struct{}) int { return len(a) - len(b) })
+
+	var ids []uint64
+	for id := range sets[0] {
+		inAll := true
+		for _, set := range sets[1:] {
+			if _, ok := set[id]; !ok {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// score is BM25 over the query terms; the caller holds the lock
+func (idx *Index) score(d *document, terms []string) float64 {
+	n := float64(len(idx.docs))
+	avgLength := float64(idx.totalTerm) / n
+	score := 0.0
+	for _, term := range terms {
+		df := float64(len(idx.postings[term]))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		tf := float64(len(d.terms[term]))
+		score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(d.length)/avgLength))
+	}
+	return score
+}
+
+// snippet cuts the text around the first query term
+func snippet(text string, terms []string) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	at := 0
+	for _, term := range terms {
+		if i := strings.Index(string(lower), term); i >= 0 {
+			at = len([]rune(string(lower)[:i]))
+			break
+		}
+	}
+	start := max(0, at-snippetBefore)
+	end := min(len(runes), at+snippetAfter)
+	out := string(runes[start:end])
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(runes) {
+		out += "…"
+	}
+	return out
+}
+
+// Search ranks the matching documents, returning at most Limit of them along with how many matched
+func (idx *Index) Search(q Query) ([]Result, int) {
+	if idx == nil {
+		return nil, 0
+	}
+	parsed := parse(q.Text)
+
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+
+	var results []Result
+	for _, id := range idx.candidates(parsed.terms) {
+		d := idx.docs[id]
+		if !q.accepts(d) {
+			continue
+		}
+		phrases := true
+		for _, phrase := range parsed.phrases {
+			if !d.hasPhrase(phrase) {
+				phrases = false
+				break
+			}
+		}
+		if !phrases {
+			continue
+		}
+		results = append(results, Result{
+			Document: d.Document,
+			Score:    idx.score(d, parsed.terms),
+			Snippet:  snippet(d.Text, parsed.terms),
+		})
+	}
+
+	// best first, newest first among equals (and for filter-only queries)
+	slices.SortFunc(results, func(a, b Result) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		return int(int64(b.RxTime) - int64(a.RxTime))
+	})
+
+	total := len(results)
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, total
+}
@@ -3,46 +3,327 @@ package state
 import (
 	"fmt"
 	"reflect"
+	"slices"
+	"strconv"
 	"submesh/submesh/types"
 	"sync"
+	"time"
+
+	"go.uber.org/zap"
 )
 
+// HistoricalWithLastByPK keeps the most recent Limit items in a ring buffer, plus the last item per primary key.
+// Items are indexed by From, To, Channel and (for message summaries) PortNum as they are added.
+// Everything returned is a copy, so it can be iterated after the lock is released.
 type HistoricalWithLastByPK[T any] struct {
-	all    []types.ParsedMessage[T]
+	// buf is a ring addressed by insertion sequence; with no Limit it simply grows
+	buf []types.ParsedMessage[T]
+	// next is the sequence number the next Add gets, count how many are still held
+	next  uint64
+	count int
+
+	byFrom    map[uint32][]uint64
+	byTo      map[uint32][]uint64
+	byChannel map[uint32][]uint64
+	byPortNum map[uint32][]uint64
+
 	lastBy map[string]*types.ParsedMessage[T]
 	lock   sync.RWMutex
 	Limit  int
+	// optional on-disk copy holding the full history
+	store      Store
+	collection string
+	logger     *zap.Logger
 }
 
 const defaultLimit = 5000
 
 func NewHistoricalWithLastByPK[T any]() HistoricalWithLastByPK[T] {
 	return HistoricalWithLastByPK[T]{
-		all:    make([]types.ParsedMessage[T], 0, defaultLimit),
-		lastBy: make(map[string]*types.ParsedMessage[T]),
-		Limit:  defaultLimit,
+		byFrom:    make(map[uint32][]uint64),
+		byTo:      make(map[uint32][]uint64),
+		byChannel: make(map[uint32][]uint64),
+		byPortNum: make(map[uint32][]uint64),
+		lastBy:    make(map[string]*types.ParsedMessage[T]),
+		Limit:     defaultLimit,
+	}
+}
+
+func portNumOf[T any](t *types.ParsedMessage[T]) (uint32, bool) {
+	if summary, ok := any(&t.Underlying).(*types.MessageSummary); ok {
+		return summary.PortNum, true
+	}
+	return 0, false
+}
+
+func (h *HistoricalWithLastByPK[T]) slot(seq uint64) int {
+	return int(seq % uint64(len(h.buf)))
+}
+
+// popIndex drops the oldest sequence from an index list, which is always the one being evicted
+func popIndex(index map[uint32][]uint64, key uint32, seq uint64) {
+	seqs := index[key]
+	if len(seqs) > 0 && seqs[0] == seq {
+		seqs = seqs[1:]
+	}
+	if len(seqs) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = seqs
+	}
+}
+
+// insert adds to the ring and indexes; the caller holds the write lock
+func (h *HistoricalWithLastByPK[T]) insert(t types.ParsedMessage[T], pks []string) {
+	if h.Limit > 0 && len(h.buf) != h.Limit {
+		h.resize(h.Limit)
+	}
+	seq := h.next
+	h.next++
+
+	if h.Limit > 0 {
+		if h.count == h.Limit {
+			oldSeq := seq - uint64(h.Limit)
+			old := &h.buf[h.slot(oldSeq)]
+			popIndex(h.byFrom, old.From, oldSeq)
+			popIndex(h.byTo, old.To, oldSeq)
+			popIndex(h.byChannel, old.Channel, oldSeq)
+			if portNum, ok := portNumOf(old); ok {
+				popIndex(h.byPortNum, portNum, oldSeq)
+			}
+		} else {
+			h.count++
+		}
+		h.buf[h.slot(seq)] = t
+	} else {
+		h.buf = append(h.buf, t)
+		h.count++
+	}
+
+	h.byFrom[t.From] = append(h.byFrom[t.From], seq)
+	h.byTo[t.To] = append(h.byTo[t.To], seq)
+	h.byChannel[t.Channel] = append(h.byChannel[t.Channel], seq)
+	if portNum, ok := portNumOf(&t); ok {
+		h.byPortNum[portNum] = append(h.byPortNum[portNum], seq)
+	}
+
+	for _, pk := range pks {
+		item := t
+		h.lastBy[pk] = &item
+	}
+}
+
+// resize reallocates the ring, keeping the newest items that fit
+func (h *HistoricalWithLastByPK[T]) resize(size int) {
+	items := h.snapshot(size)
+	h.buf = make([]types.ParsedMessage[T], size)
+	h.count = 0
+	h.byFrom = make(map[uint32][]uint64)
+	h.byTo = make(map[uint32][]uint64)
+	h.byChannel = make(map[uint32][]uint64)
+	h.byPortNum = make(map[uint32][]uint64)
+	h.next -= uint64(len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		h.insert(items[i], nil)
+	}
+}
+
+// snapshot copies up to limit items, newest first; the caller holds the lock
+func (h *HistoricalWithLastByPK[T]) snapshot(limit int) []types.ParsedMessage[T] {
+	n := h.count
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	items := make([]types.ParsedMessage[T], 0, n)
+	for i := 0; i < n; i++ {
+		items = append(items, h.buf[h.slot(h.next-1-uint64(i))])
 	}
+	return items
+}
+
+// fromIndex copies the indexed items, newest first; the caller holds the lock
+func (h *HistoricalWithLastByPK[T]) fromIndex(seqs []uint64, limit int) []types.ParsedMessage[T] {
+	n := len(seqs)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	items := make([]types.ParsedMessage[T], 0, n)
+	for i := len(seqs) - 1; i >= len(seqs)-n; i-- {
+		items = append(items, h.buf[h.slot(seqs[i])])
+	}
+	return items
 }
 
 func (h *HistoricalWithLastByPK[T]) Add(t types.ParsedMessage[T], pks ...string) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
 
-	//prepend to all
-	h.all = append([]types.ParsedMessage[T]{t}, h.all...)
-	if h.Limit > 0 && len(h.all) > h.Limit {
-		h.all = h.all[:h.Limit]
+	h.insert(t, pks)
+
+	if h.store != nil {
+		record, err := encodeMessage(&t)
+		if err == nil {
+			err = h.store.Append(h.collection, t.RxTime, record, pks)
+		}
+		if err != nil {
+			h.logger.Error("error storing message", zap.String("collection", h.collection), zap.Uint32("id", t.Id), zap.Error(err))
+		}
+	}
+}
+
+// Persist attaches a store to the collection and loads the most recent Limit entries from it
+func (h *HistoricalWithLastByPK[T]) Persist(collection string, store Store, logger *zap.Logger) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.store = store
+	h.collection = collection
+	h.logger = logger
+
+	recent := []types.ParsedMessage[T]{}
+	err := store.Recent(collection, h.Limit, func(record []byte) error {
+		var t types.ParsedMessage[T]
+		if err := decodeMessage(record, &t); err != nil {
+			return err
+		}
+		recent = append(recent, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(recent) - 1; i >= 0; i-- {
+		h.insert(recent[i], nil)
 	}
 
-	for _, pk := range pks {
+	return store.LastBy(collection, func(pk string, record []byte) error {
+		var t types.ParsedMessage[T]
+		if err := decodeMessage(record, &t); err != nil {
+			return err
+		}
 		h.lastBy[pk] = &t
+		return nil
+	})
+}
+
+// Range is every item received in [from, to), newest first, reaching past Limit when backed by a store
+func (h *HistoricalWithLastByPK[T]) Range(from time.Time, to time.Time, limit int) []types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var ranged []types.ParsedMessage[T]
+
+	if h.store != nil {
+		h.store.Range(h.collection, uint32(from.Unix()), uint32(to.Unix()), limit, func(record []byte) error {
+			var t types.ParsedMessage[T]
+			if err := decodeMessage(record, &t); err != nil {
+				return err
+			}
+			ranged = append(ranged, t)
+			return nil
+		})
+		return ranged
 	}
+
+	for i := 0; i < h.count; i++ {
+		item := &h.buf[h.slot(h.next-1-uint64(i))]
+		if int64(item.RxTime) >= from.Unix() && int64(item.RxTime) < to.Unix() {
+			ranged = append(ranged, *item)
+			if limit > 0 && len(ranged) >= limit {
+				break
+			}
+		}
+	}
+	return ranged
 }
 
+// All items, newest first
 func (h *HistoricalWithLastByPK[T]) All() []types.ParsedMessage[T] {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
-	return h.all
+	return h.snapshot(0)
+}
+
+// Recent is up to limit items, newest first
+func (h *HistoricalWithLastByPK[T]) Recent(limit int) []types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.snapshot(limit)
+}
+
+func (h *HistoricalWithLastByPK[T]) Len() int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.count
+}
+
+func (h *HistoricalWithLastByPK[T]) ByFrom(from uint32, limit int) []types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.fromIndex(h.byFrom[from], limit)
+}
+
+func (h *HistoricalWithLastByPK[T]) ByTo(to uint32, limit int) []types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.fromIndex(h.byTo[to], limit)
+}
+
+func (h *HistoricalWithLastByPK[T]) ByChannel(channel uint32, limit int) []types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.fromIndex(h.byChannel[channel], limit)
+}
+
+// ByPortNum only has entries for collections of types.MessageSummary
+func (h *HistoricalWithLastByPK[T]) ByPortNum(portNum uint32, limit int) []types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.fromIndex(h.byPortNum[portNum], limit)
+}
+
+// Page is one page of the collection, read from the store when one is attached so it reaches past Limit
+func (h *HistoricalWithLastByPK[T]) Page(q PageQuery) Page[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if h.store != nil {
+		return h.storePage(q)
+	}
+	return PageOf(h.snapshot(0), q)
+}
+
+func (h *HistoricalWithLastByPK[T]) PageByFrom(from uint32, q PageQuery) Page[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return PageOf(h.fromIndex(h.byFrom[from], 0), q)
+}
+
+func (h *HistoricalWithLastByPK[T]) PageByTo(to uint32, q PageQuery) Page[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return PageOf(h.fromIndex(h.byTo[to], 0), q)
+}
+
+func (h *HistoricalWithLastByPK[T]) PageByChannel(channel uint32, q PageQuery) Page[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return PageOf(h.fromIndex(h.byChannel[channel], 0), q)
+}
+
+func (h *HistoricalWithLastByPK[T]) PageByPortNum(portNum uint32, q PageQuery) Page[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return PageOf(h.fromIndex(h.byPortNum[portNum], 0), q)
+}
+
+// LastFrom is the most recent item sent by a node, in O(1)
+func (h *HistoricalWithLastByPK[T]) LastFrom(from uint32) *types.ParsedMessage[T] {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	seqs := h.byFrom[from]
+	if len(seqs) == 0 {
+		return nil
+	}
+	item := h.buf[h.slot(seqs[len(seqs)-1])]
+	return &item
 }
 
 func (h *HistoricalWithLastByPK[T]) LastBy(pk string) *types.ParsedMessage[T] {
@@ -50,10 +331,36 @@ func (h *HistoricalWithLastByPK[T]) LastBy(pk string) *types.ParsedMessage[T] {
 	defer h.lock.RUnlock()
 	return h.lastBy[pk]
 }
+
+// indexFor maps the indexed property names onto their index
+func (h *HistoricalWithLastByPK[T]) indexFor(property string) map[uint32][]uint64 {
+	switch property {
+	case "From":
+		return h.byFrom
+	case "To":
+		return h.byTo
+	case "Channel":
+		return h.byChannel
+	}
+	return nil
+}
+
 func (h *HistoricalWithLastByPK[T]) LastByProperty(pk string, prop string) *types.ParsedMessage[T] {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
-	for _, prk := range h.all {
+	if index := h.indexFor(pk); index != nil {
+		key, err := strconv.ParseUint(prop, 10, 32)
+		if err != nil {
+			return nil
+		}
+		items := h.fromIndex(index[uint32(key)], 1)
+		if len(items) == 0 {
+			return nil
+		}
+		return &items[0]
+	}
+	for i := 0; i < h.count; i++ {
+		prk := h.buf[h.slot(h.next-1-uint64(i))]
 		val := reflect.ValueOf(prk).FieldByName(pk)
 		if prop == coalesceReflectValueToString(val) {
 			return &prk
@@ -78,12 +385,26 @@ func (h *HistoricalWithLastByPK[T]) OnlyMostRecentByPropertyString(pk string) []
 	h.lock.RLock()
 	defer h.lock.RUnlock()
 	var onlyLast []types.ParsedMessage[T]
-	added := map[string]bool{}
 
-	for _, item := range h.all {
-		name := coalesceReflectValueToString(reflect.ValueOf(item).FieldByName(pk))
+	if index := h.indexFor(pk); index != nil {
+		latest := make([]uint64, 0, len(index))
+		for _, seqs := range index {
+			latest = append(latest, seqs[len(seqs)-1])
+		}
+		slices.Sort(latest)
+		slices.Reverse(latest)
+		for _, seq := range latest {
+			onlyLast = append(onlyLast, h.buf[h.slot(seq)])
+		}
+		return onlyLast
+	}
+
+	added := map[string]bool{}
+	for i := 0; i < h.count; i++ {
+		item := &h.buf[h.slot(h.next-1-uint64(i))]
+		name := coalesceReflectValueToString(reflect.ValueOf(item).Elem().FieldByName(pk))
 		if !added[name] {
-			onlyLast = append(onlyLast, item)
+			onlyLast = append(onlyLast, *item)
 			added[name] = true
 		}
 	}
@@ -98,10 +419,11 @@ func (h *HistoricalWithLastByPK[T]) OnlyMostRecentByUnderlyingPropertyString(pk
 	var onlyLast []types.ParsedMessage[T]
 	added := map[string]bool{}
 
-	for _, item := range h.all {
-		name := coalesceReflectValueToString(reflect.ValueOf(item.Underlying).FieldByName(pk))
+	for i := 0; i < h.count; i++ {
+		item := &h.buf[h.slot(h.next-1-uint64(i))]
+		name := coalesceReflectValueToString(reflect.ValueOf(&item.Underlying).Elem().FieldByName(pk))
 		if !added[name] {
-			onlyLast = append(onlyLast, item)
+			onlyLast = append(onlyLast, *item)
 			added[name] = true
 		}
 	}
@@ -113,12 +435,21 @@ func (h *HistoricalWithLastByPK[T]) OnlyMostRecentByUnderlyingPropertyString(pk
 func (h *HistoricalWithLastByPK[T]) FilteredByString(property string, value string) []types.ParsedMessage[T] {
 	h.lock.RLock()
 	defer h.lock.RUnlock()
-	var onlyLast []types.ParsedMessage[T]
 
-	for _, item := range h.all {
-		name := coalesceReflectValueToString(reflect.ValueOf(item).FieldByName(property))
+	if index := h.indexFor(property); index != nil {
+		key, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil
+		}
+		return h.fromIndex(index[uint32(key)], 0)
+	}
+
+	var onlyLast []types.ParsedMessage[T]
+	for i := 0; i < h.count; i++ {
+		item := &h.buf[h.slot(h.next-1-uint64(i))]
+		name := coalesceReflectValueToString(reflect.ValueOf(item).Elem().FieldByName(property))
 		if name == value {
-			onlyLast = append(onlyLast, item)
+			onlyLast = append(onlyLast, *item)
 		}
 	}
 
@@ -131,10 +462,11 @@ func (h *HistoricalWithLastByPK[T]) FilteredByUnderlyingString(property string,
 	defer h.lock.RUnlock()
 	var onlyLast []types.ParsedMessage[T]
 
-	for _, item := range h.all {
-		name := coalesceReflectValueToString(reflect.ValueOf(item.Underlying).FieldByName(property))
+	for i := 0; i < h.count; i++ {
+		item := &h.buf[h.slot(h.next-1-uint64(i))]
+		name := coalesceReflectValueToString(reflect.ValueOf(&item.Underlying).Elem().FieldByName(property))
 		if name == value {
-			onlyLast = append(onlyLast, item)
+			onlyLast = append(onlyLast, *item)
 		}
 	}
 
@@ -0,0 +1,155 @@
+package state
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.uber.org/zap"
+)
+
+const defaultDedupTTL = 30 * time.Minute
+
+// Dedup remembers (From, Packet.Id) pairs so each logical packet is only processed once
+type Dedup struct {
+	seen map[uint64]time.Time
+	lock sync.Mutex
+	// TTL is how long a packet id is remembered for
+	TTL     time.Duration
+	Enabled bool
+	// DuringCatchup controls whether replayed packets from the file log are deduplicated too
+	DuringCatchup bool
+	hits          uint64
+	// swept is when Seen last dropped expired ids, by the times it was given
+	swept time.Time
+	// optional on-disk copy of the ids as they're first seen
+	store  Store
+	logger *zap.Logger
+}
+
+// dedupRecord is a packet id being remembered as the store keeps it
+type dedupRecord struct {
+	Key uint64    `cbor:"1,keyasint"`
+	At  time.Time `cbor:"2,keyasint"`
+}
+
+const dedupCollection = "dedup"
+
+func NewDedup() *Dedup {
+	return &Dedup{
+		seen:          make(map[uint64]time.Time),
+		TTL:           defaultDedupTTL,
+		Enabled:       true,
+		DuringCatchup: true,
+	}
+}
+
+func dedupKey(from uint32, id uint32) uint64 {
+	return uint64(from)<<32 | uint64(id)
+}
+
+// Seen marks the packet as processed at the given time and reports whether it already was within the TTL
+func (d *Dedup) Seen(from uint32, id uint32, at time.Time, catchup bool) bool {
+	if !d.Enabled || (catchup && !d.DuringCatchup) {
+		return false
+	}
+	// packets without an id can't be told apart
+	if id == 0 {
+		return false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// catchup runs on log time rather than the clock and the sweeper isn't running yet,
+	// so expired ids are also dropped here once per TTL of the times seen
+	if at.Sub(d.swept) >= d.TTL {
+		d.sweep(at)
+		d.swept = at
+	}
+
+	key := dedupKey(from, id)
+	if prev, ok := d.seen[key]; ok && at.Sub(prev) < d.TTL {
+		if !catchup {
+			d.hits++
+		}
+		return true
+	}
+	d.seen[key] = at
+	if d.store != nil {
+		record, err := snapshotEncMode.Marshal(dedupRecord{Key: key, At: at})
+		if err == nil {
+			err = d.store.Append(dedupCollection, uint32(at.Unix()), record, nil)
+		}
+		if err != nil {
+			d.logger.Error("error storing packet id", zap.Uint32("from", from), zap.Uint32("id", id), zap.Error(err))
+		}
+	}
+	return false
+}
+
+// Persist attaches a store and loads the ids it remembered from since on
+func (d *Dedup) Persist(store Store, logger *zap.Logger, since time.Time) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.store = store
+	d.logger = logger
+	return store.RangeForward(dedupCollection, uint32(max(since.Unix(), 0)), math.MaxUint32, 0, func(raw []byte) error {
+		var record dedupRecord
+		if err := cbor.Unmarshal(raw, &record); err != nil {
+			return err
+		}
+		if record.At.After(d.seen[record.Key]) {
+			d.seen[record.Key] = record.At
+		}
+		return nil
+	})
+}
+
+// Sweep forgets every packet id older than the TTL and returns how many were removed
+func (d *Dedup) Sweep(now time.Time) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.sweep(now)
+}
+
+func (d *Dedup) sweep(now time.Time) int {
+	removed := 0
+	for key, at := range d.seen {
+		if now.Sub(at) >= d.TTL {
+			delete(d.seen, key)
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartSweeper sweeps expired entries every interval until the context is done; it does nothing without an interval
+func (d *Dedup) StartSweeper(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.Sweep(now)
+		}
+	}
+}
+
+func (d *Dedup) Len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.seen)
+}
+
+// Hits is the number of live duplicates dropped so far, leaving out the catchup replay
+func (d *Dedup) Hits() uint64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.hits
+}
@@ -0,0 +1,165 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"submesh/submesh/types"
+)
+
+// Cursor is a position in a collection ordered newest first by receive time, then packet id
+type Cursor struct {
+	RxTime uint32
+	Id     uint32
+}
+
+func CursorOf[T any](m *types.ParsedMessage[T]) Cursor {
+	return Cursor{RxTime: m.RxTime, Id: m.Id}
+}
+
+func (c Cursor) Newer(o Cursor) bool {
+	if c.RxTime != o.RxTime {
+		return c.RxTime > o.RxTime
+	}
+	return c.Id > o.Id
+}
+
+func (c Cursor) String() string {
+	return fmt.Sprintf("%d-%d", c.RxTime, c.Id)
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	rxTime, id, ok := strings.Cut(s, "-")
+	if !ok {
+		return Cursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	t, err := strconv.ParseUint(rxTime, 10, 32)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	i, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	return Cursor{RxTime: uint32(t), Id: uint32(i)}, nil
+}
+
+// PageQuery asks for Limit items older than Before or newer than After; with neither it is the newest page
+type PageQuery struct {
+	Before *Cursor
+	After  *Cursor
+	Limit  int
+}
+
+type Page[T any] struct {
+	Items []types.ParsedMessage[T]
+	// Prev is passed as After for the newer page, Next as Before for the older one; nil when there is none
+	Prev *Cursor
+	Next *Cursor
+}
+
+// PageOf cuts one page out of items, sorting them in place
+func PageOf[T any](items []types.ParsedMessage[T], q PageQuery) Page[T] {
+	slices.SortStableFunc(items, func(a, b types.ParsedMessage[T]) int {
+		ca, cb := CursorOf(&a), CursorOf(&b)
+		if ca.Newer(cb) {
+			return -1
+		}
+		if cb.Newer(ca) {
+			return 1
+		}
+		return 0
+	})
+
+	start, end := 0, len(items)
+	switch {
+	case q.Before != nil:
+		start = sort.Search(len(items), func(i int) bool { return q.Before.Newer(CursorOf(&items[i])) })
+		if q.Limit > 0 {
+			end = min(start+q.Limit, len(items))
+		}
+	case q.After != nil:
+		end = sort.Search(len(items), func(i int) bool { return !CursorOf(&items[i]).Newer(*q.After) })
+		if q.Limit > 0 {
+			start = max(0, end-q.Limit)
+		}
+	default:
+		if q.Limit > 0 {
+			end = min(q.Limit, len(items))
+		}
+	}
+
+	page := Page[T]{Items: items[start:end]}
+	if start < end {
+		if start > 0 {
+			prev := CursorOf(&items[start])
+			page.Prev = &prev
+		}
+		if end < len(items) {
+			next := CursorOf(&items[end-1])
+			page.Next = &next
+		}
+	}
+	return page
+}
+
+var errPageFull = errors.New("page full")
+
+// storePage reads just enough of the store to fill the page; the caller holds the lock
+func (h *HistoricalWithLastByPK[T]) storePage(q PageQuery) Page[T] {
+	var items []types.ParsedMessage[T]
+	matched := 0
+	// once past the page, finish the second being read so ties on RxTime still sort by id
+	var boundary *uint32
+	collect := func(record []byte) error {
+		var t types.ParsedMessage[T]
+		if err := decodeMessage(record, &t); err != nil {
+			return err
+		}
+		if boundary != nil && t.RxTime != *boundary {
+			return errPageFull
+		}
+		items = append(items, t)
+		c := CursorOf(&t)
+		if (q.Before == nil || q.Before.Newer(c)) && (q.After == nil || c.Newer(*q.After)) {
+			matched++
+		}
+		if q.Limit > 0 && matched > q.Limit && boundary == nil {
+			boundary = &t.RxTime
+		}
+		return nil
+	}
+
+	var err error
+	switch {
+	case q.After != nil:
+		err = h.store.RangeForward(h.collection, q.After.RxTime, math.MaxUint32, 0, collect)
+	case q.Before != nil && q.Before.RxTime < math.MaxUint32:
+		// the cursor's own second is read too, for the ids below it
+		err = h.store.Range(h.collection, 0, q.Before.RxTime+1, 0, collect)
+	default:
+		// the newest page, or a cursor in the last second, where RxTime+1 would wrap to 0
+		err = h.store.Recent(h.collection, 0, collect)
+	}
+	if err != nil && !errors.Is(err, errPageFull) {
+		return Page[T]{}
+	}
+
+	page := PageOf(items, q)
+	// only one side of the cursor was read, so assume the other side is still there
+	if len(page.Items) > 0 {
+		if q.Before != nil && page.Prev == nil {
+			prev := CursorOf(&page.Items[0])
+			page.Prev = &prev
+		}
+		if q.After != nil && page.Next == nil {
+			next := CursorOf(&page.Items[len(page.Items)-1])
+			page.Next = &next
+		}
+	}
+	return page
+}
@@ -0,0 +1,204 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"submesh/submesh/types"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.uber.org/zap"
+)
+
+// Receptions groups every copy of a packet heard through our gateways under one (From, Id) key
+type Receptions struct {
+	byPacket map[string]*types.PacketReceptions
+	order    []string
+	lock     sync.RWMutex
+	Limit    int
+	// optional on-disk copy, written a reception at a time
+	store  Store
+	logger *zap.Logger
+}
+
+// receptionRecord is one reception as the store keeps it
+type receptionRecord struct {
+	From      uint32          `cbor:"1,keyasint"`
+	To        uint32          `cbor:"2,keyasint"`
+	Id        uint32          `cbor:"3,keyasint"`
+	Reception types.Reception `cbor:"4,keyasint"`
+}
+
+const receptionsCollection = "receptions"
+
+type GatewayCoverage struct {
+	GatewayId string
+	Node      uint32
+	Packets   int
+	BestRssi  int32
+	BestSnr   float32
+	MinHops   uint32
+	LastHeard uint32
+}
+
+func NewReceptions() Receptions {
+	return Receptions{
+		byPacket: make(map[string]*types.PacketReceptions),
+		order:    make([]string, 0, defaultLimit),
+		Limit:    defaultLimit,
+	}
+}
+
+func packetKey(from uint32, id uint32) string {
+	return fmt.Sprintf("%d/%d", from, id)
+}
+
+// Add records a reception and returns how many gateways have now heard the packet
+func (r *Receptions) Add(from uint32, to uint32, id uint32, rcv types.Reception) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	count, added := r.add(from, to, id, rcv)
+	if added && r.store != nil {
+		record, err := cbor.Marshal(receptionRecord{From: from, To: to, Id: id, Reception: rcv})
+		if err == nil {
+			err = r.store.Append(receptionsCollection, rcv.RxTime, record, nil)
+		}
+		if err != nil {
+			r.logger.Error("error storing reception", zap.Uint32("from", from), zap.Uint32("id", id), zap.Error(err))
+		}
+	}
+	return count
+}
+
+// add reports whether rcv was new; the caller holds the write lock
+func (r *Receptions) add(from uint32, to uint32, id uint32, rcv types.Reception) (int, bool) {
+	key := packetKey(from, id)
+	pr, ok := r.byPacket[key]
+	if !ok {
+		pr = &types.PacketReceptions{
+			From:      from,
+			To:        to,
+			Id:        id,
+			FirstSeen: rcv.RxTime,
+		}
+		r.byPacket[key] = pr
+		r.order = append(r.order, key)
+		if r.Limit > 0 && len(r.order) > r.Limit {
+			delete(r.byPacket, r.order[0])
+			r.order = r.order[1:]
+		}
+	}
+	// catchup replays the high-water mark's second, which may already be here
+	if slices.Contains(pr.Receptions, rcv) {
+		return len(pr.Receptions), false
+	}
+	pr.Receptions = append(pr.Receptions, rcv)
+	return len(pr.Receptions), true
+}
+
+var errEnoughReceptions = errors.New("enough receptions")
+
+// Persist attaches a store and loads the receptions of the most recent Limit packets from it
+func (r *Receptions) Persist(store Store, logger *zap.Logger) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.store = store
+	r.logger = logger
+
+	var records []receptionRecord
+	packets := map[string]bool{}
+	err := store.Recent(receptionsCollection, 0, func(raw []byte) error {
+		var record receptionRecord
+		if err := cbor.Unmarshal(raw, &record); err != nil {
+			return err
+		}
+		key := packetKey(record.From, record.Id)
+		if !packets[key] {
+			if r.Limit > 0 && len(packets) == r.Limit {
+				return errEnoughReceptions
+			}
+			packets[key] = true
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil && err != errEnoughReceptions {
+		return err
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		r.add(records[i].From, records[i].To, records[i].Id, records[i].Reception)
+	}
+	return nil
+}
+
+// Get returns a copy of the receptions for a packet, or nil if we never saw it
+func (r *Receptions) Get(from uint32, id uint32) *types.PacketReceptions {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	pr, ok := r.byPacket[packetKey(from, id)]
+	if !ok {
+		return nil
+	}
+	cp := *pr
+	cp.Receptions = slices.Clone(pr.Receptions)
+	return &cp
+}
+
+func (r *Receptions) Count(from uint32, id uint32) int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	pr, ok := r.byPacket[packetKey(from, id)]
+	if !ok {
+		return 0
+	}
+	return len(pr.Receptions)
+}
+
+// Coverage summarises, per gateway and originating node, how well the gateway hears that node
+func (r *Receptions) Coverage() []GatewayCoverage {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	byPair := map[string]*GatewayCoverage{}
+	for _, pr := range r.byPacket {
+		for _, rcv := range pr.Receptions {
+			key := fmt.Sprintf("%s/%d", rcv.GatewayId, pr.From)
+			cov, ok := byPair[key]
+			if !ok {
+				cov = &GatewayCoverage{
+					GatewayId: rcv.GatewayId,
+					Node:      pr.From,
+					BestRssi:  rcv.RxRssi,
+					BestSnr:   rcv.RxSnr,
+					MinHops:   rcv.HopsAway(),
+				}
+				byPair[key] = cov
+			}
+			cov.Packets++
+			// gateways that don't report rssi send 0
+			if rcv.RxRssi != 0 && (cov.BestRssi == 0 || rcv.RxRssi > cov.BestRssi) {
+				cov.BestRssi = rcv.RxRssi
+			}
+			cov.BestSnr = max(cov.BestSnr, rcv.RxSnr)
+			cov.MinHops = min(cov.MinHops, rcv.HopsAway())
+			cov.LastHeard = max(cov.LastHeard, rcv.RxTime)
+		}
+	}
+
+	coverage := make([]GatewayCoverage, 0, len(byPair))
+	for _, cov := range byPair {
+		coverage = append(coverage, *cov)
+	}
+	slices.SortFunc(coverage, func(a, b GatewayCoverage) int {
+		if a.GatewayId != b.GatewayId {
+			if a.GatewayId < b.GatewayId {
+				return -1
+			}
+			return 1
+		}
+		return b.Packets - a.Packets
+	})
+	return coverage
+}
@@ -0,0 +1,218 @@
+package state
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"submesh/submesh/types"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// snapshotVersion changes whenever the layout below does; older snapshots are ignored
+const snapshotVersion = 1
+
+// collectionSnapshot holds one collection as store records
+type collectionSnapshot struct {
+	// Items are oldest first
+	Items  [][]byte          `cbor:"1,keyasint"`
+	LastBy map[string][]byte `cbor:"2,keyasint"`
+}
+
+type snapshot struct {
+	Version int `cbor:"1,keyasint"`
+	// HighWater is the capture time of the last log entry in the snapshot
+	HighWater   time.Time                     `cbor:"2,keyasint"`
+	Collections map[string]collectionSnapshot `cbor:"3,keyasint"`
+	// Receptions are oldest first
+	Receptions []types.PacketReceptions `cbor:"4,keyasint"`
+	Dedup      map[uint64]time.Time     `cbor:"5,keyasint"`
+}
+
+var ErrSnapshotVersion = errors.New("snapshot is from another version")
+
+// times keep their nanoseconds so dedup and receptions come back as they were
+var snapshotEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+type snapshotter interface {
+	exportSnapshot() (collectionSnapshot, error)
+	restoreSnapshot(c collectionSnapshot) error
+}
+
+// snapshotters are the collections by the names the store uses
+func (s *State) snapshotters() map[string]snapshotter {
+	return map[string]snapshotter{
+		"users":          &s.Users,
+		"telemetry":      &s.Telemetry,
+		"chats":          &s.Chats,
+		"nondecryptable": &s.NonDecryptable,
+		"all":            &s.AllMessages,
+		"neighbors":      &s.Neighbors,
+		"positions":      &s.Positions,
+		"traceroutes":    &s.Traceroutes,
+	}
+}
+
+func (h *HistoricalWithLastByPK[T]) exportSnapshot() (collectionSnapshot, error) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	c := collectionSnapshot{
+		Items:  make([][]byte, 0, h.count),
+		LastBy: make(map[string][]byte, len(h.lastBy)),
+	}
+	items := h.snapshot(0)
+	for i := len(items) - 1; i >= 0; i-- {
+		record, err := encodeMessage(&items[i])
+		if err != nil {
+			return c, err
+		}
+		c.Items = append(c.Items, record)
+	}
+	for pk, item := range h.lastBy {
+		record, err := encodeMessage(item)
+		if err != nil {
+			return c, err
+		}
+		c.LastBy[pk] = record
+	}
+	return c, nil
+}
+
+func (h *HistoricalWithLastByPK[T]) restoreSnapshot(c collectionSnapshot) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, record := range c.Items {
+		var t types.ParsedMessage[T]
+		if err := decodeMessage(record, &t); err != nil {
+			return err
+		}
+		h.insert(t, nil)
+	}
+	for pk, record := range c.LastBy {
+		var t types.ParsedMessage[T]
+		if err := decodeMessage(record, &t); err != nil {
+			return err
+		}
+		h.lastBy[pk] = &t
+	}
+	return nil
+}
+
+func (r *Receptions) exportSnapshot() []types.PacketReceptions {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	out := make([]types.PacketReceptions, 0, len(r.order))
+	for _, key := range r.order {
+		out = append(out, *r.byPacket[key])
+	}
+	return out
+}
+
+func (r *Receptions) restoreSnapshot(prs []types.PacketReceptions) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range prs {
+		pr := prs[i]
+		key := packetKey(pr.From, pr.Id)
+		r.byPacket[key] = &pr
+		r.order = append(r.order, key)
+		if r.Limit > 0 && len(r.order) > r.Limit {
+			delete(r.byPacket, r.order[0])
+			r.order = r.order[1:]
+		}
+	}
+}
+
+func (d *Dedup) exportSnapshot() map[uint64]time.Time {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	seen := make(map[uint64]time.Time, len(d.seen))
+	for key, at := range d.seen {
+		seen[key] = at
+	}
+	return seen
+}
+
+func (d *Dedup) restoreSnapshot(seen map[uint64]time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for key, at := range seen {
+		d.seen[key] = at
+	}
+}
+
+// WriteSnapshot saves every collection, the receptions and the dedup window to path, replacing it atomically.
+// It returns the high-water mark the snapshot was taken at
+func (s *State) WriteSnapshot(path string) (time.Time, error) {
+	// packet handling waits while everything is copied, so the mark covers exactly what's in the collections
+	s.handling.Lock()
+	snap := snapshot{
+		Version:     snapshotVersion,
+		HighWater:   s.HighWater(),
+		Collections: map[string]collectionSnapshot{},
+	}
+	for name, c := range s.snapshotters() {
+		exported, err := c.exportSnapshot()
+		if err != nil {
+			s.handling.Unlock()
+			return snap.HighWater, fmt.Errorf("%s: %w", name, err)
+		}
+		snap.Collections[name] = exported
+	}
+	snap.Receptions = s.Receptions.exportSnapshot()
+	snap.Dedup = s.Dedup.exportSnapshot()
+	s.handling.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return snap.HighWater, err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Chmod(0644)
+	w := bufio.NewWriter(tmp)
+	if err := snapshotEncMode.NewEncoder(w).Encode(snap); err != nil {
+		tmp.Close()
+		return snap.HighWater, err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return snap.HighWater, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return snap.HighWater, err
+	}
+	if err := tmp.Close(); err != nil {
+		return snap.HighWater, err
+	}
+	return snap.HighWater, os.Rename(tmp.Name(), path)
+}
+
+// RestoreSnapshot loads a snapshot written by WriteSnapshot into a new state, which then reports its high-water mark.
+// On an error the state may be partly filled and should be thrown away
+func (s *State) RestoreSnapshot(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var snap snapshot
+	if err := cbor.NewDecoder(bufio.NewReader(file)).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+	for name, c := range s.snapshotters() {
+		if err := c.restoreSnapshot(snap.Collections[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	s.Receptions.restoreSnapshot(snap.Receptions)
+	s.Dedup.restoreSnapshot(snap.Dedup)
+	s.MarkProcessed(snap.HighWater)
+	return nil
+}
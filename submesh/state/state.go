@@ -2,9 +2,11 @@ package state
 
 import (
 	"submesh/submesh/types"
+	"sync"
 	"time"
 
 	"buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"go.uber.org/zap"
 )
 
 type State struct {
@@ -16,7 +18,15 @@ type State struct {
 	Neighbors      HistoricalWithLastByPK[meshtastic.NeighborInfo]
 	Positions      HistoricalWithLastByPK[meshtastic.Position]
 	Traceroutes    HistoricalWithLastByPK[meshtastic.RouteDiscovery]
-	ProcessedHash  map[string]time.Time
+	Receptions     Receptions
+	Dedup          *Dedup
+	store          Store
+	logger         *zap.Logger
+	// processed is the capture time of the newest packet handled
+	processed     time.Time
+	processedLock sync.Mutex
+	// handling is held for reading while a packet is handled and for writing while a snapshot is taken
+	handling sync.RWMutex
 }
 
 func NewState() *State {
@@ -29,6 +39,7 @@ func NewState() *State {
 		Neighbors:      NewHistoricalWithLastByPK[meshtastic.NeighborInfo](),
 		Positions:      NewHistoricalWithLastByPK[meshtastic.Position](),
 		Traceroutes:    NewHistoricalWithLastByPK[meshtastic.RouteDiscovery](),
-		ProcessedHash:  make(map[string]time.Time),
+		Receptions:     NewReceptions(),
+		Dedup:          NewDedup(),
 	}
 }
@@ -0,0 +1,128 @@
+package state
+
+import (
+	"submesh/submesh/types"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// Store is an on-disk backend for the HistoricalWithLastByPK collections.
+// Records are opaque to the store; they are indexed by collection, receive time and primary keys.
+type Store interface {
+	Append(collection string, rxTime uint32, record []byte, pks []string) error
+	// Recent calls fn for up to limit records, newest first
+	Recent(collection string, limit int, fn func(record []byte) error) error
+	// Range calls fn for records with from <= rxTime < to, newest first, stopping after limit if limit > 0
+	Range(collection string, from uint32, to uint32, limit int, fn func(record []byte) error) error
+	// RangeForward is Range walking oldest first
+	RangeForward(collection string, from uint32, to uint32, limit int, fn func(record []byte) error) error
+	// LastBy calls fn for every primary key with the record most recently stored under it
+	LastBy(collection string, fn func(pk string, record []byte) error) error
+	SetHighWater(t time.Time) error
+	HighWater() (time.Time, error)
+	Close() error
+}
+
+// protobuf messages go through proto since their oneofs don't survive reflection based encoders
+func encodeMessage[T any](m *types.ParsedMessage[T]) ([]byte, error) {
+	var underlying []byte
+	var err error
+	if pm, ok := any(&m.Underlying).(proto.Message); ok {
+		underlying, err = proto.Marshal(pm)
+	} else {
+		underlying, err = cbor.Marshal(m.Underlying)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(types.Rewrap(m, underlying))
+}
+
+func decodeMessage[T any](record []byte, m *types.ParsedMessage[T]) error {
+	var raw types.ParsedMessage[[]byte]
+	if err := cbor.Unmarshal(record, &raw); err != nil {
+		return err
+	}
+	*m = types.Rewrap(&raw, *new(T))
+	if pm, ok := any(&m.Underlying).(proto.Message); ok {
+		return proto.Unmarshal(raw.Underlying, pm)
+	}
+	return cbor.Unmarshal(raw.Underlying, &m.Underlying)
+}
+
+// Persist backs every collection, the receptions and the dedup window with the store and loads what it already holds
+func (s *State) Persist(store Store, logger *zap.Logger) error {
+	s.store = store
+	s.logger = logger
+	if err := s.Users.Persist("users", store, logger); err != nil {
+		return err
+	}
+	if err := s.Telemetry.Persist("telemetry", store, logger); err != nil {
+		return err
+	}
+	if err := s.Chats.Persist("chats", store, logger); err != nil {
+		return err
+	}
+	if err := s.NonDecryptable.Persist("nondecryptable", store, logger); err != nil {
+		return err
+	}
+	if err := s.AllMessages.Persist("all", store, logger); err != nil {
+		return err
+	}
+	if err := s.Neighbors.Persist("neighbors", store, logger); err != nil {
+		return err
+	}
+	if err := s.Positions.Persist("positions", store, logger); err != nil {
+		return err
+	}
+	if err := s.Traceroutes.Persist("traceroutes", store, logger); err != nil {
+		return err
+	}
+	if err := s.Receptions.Persist(store, logger); err != nil {
+		return err
+	}
+	// ids older than a TTL before the high-water mark can't catch anything catchup replays
+	hw, err := store.HighWater()
+	if err != nil {
+		return err
+	}
+	return s.Dedup.Persist(store, logger, hw.Add(-s.Dedup.TTL))
+}
+
+// Handling holds off snapshots until the returned func is called, so a packet is either all in a snapshot or not at all
+func (s *State) Handling() (done func()) {
+	s.handling.RLock()
+	return s.handling.RUnlock
+}
+
+// MarkProcessed records how far into the file log the state has seen
+func (s *State) MarkProcessed(t time.Time) {
+	s.processedLock.Lock()
+	if t.After(s.processed) {
+		s.processed = t
+	}
+	s.processedLock.Unlock()
+	if s.store != nil {
+		if err := s.store.SetHighWater(t); err != nil {
+			s.logger.Error("error storing high water mark", zap.Time("high_water", t), zap.Error(err))
+		}
+	}
+}
+
+// HighWater is the capture time of the last log entry already in the state, kept in the store or a snapshot; zero without either
+func (s *State) HighWater() time.Time {
+	s.processedLock.Lock()
+	hw := s.processed
+	s.processedLock.Unlock()
+	if s.store == nil {
+		return hw
+	}
+	t, err := s.store.HighWater()
+	if err != nil || t.Before(hw) {
+		return hw
+	}
+	return t
+}
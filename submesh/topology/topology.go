@@ -0,0 +1,201 @@
+package topology
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"submesh/submesh/keyring"
+	"submesh/submesh/state"
+	"time"
+
+	"buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+)
+
+// Where a link was seen
+const (
+	SourceNeighborInfo = "neighborinfo"
+	SourceTraceroute   = "traceroute"
+)
+
+const broadcast = 0xffffffff
+
+// traceroute snr is dB scaled by 4, with this meaning unknown
+const unknownSnr = math.MinInt8
+
+// Options shape how old observations count
+type Options struct {
+	// HalfLife is how long it takes an observation to count half as much
+	HalfLife time.Duration
+	// MaxAge drops observations older than this; 0 keeps everything in state
+	MaxAge time.Duration
+}
+
+type Node struct {
+	Id        uint32   `json:"id"`
+	IdHex     string   `json:"id_hex"`
+	LongName  string   `json:"long_name"`
+	ShortName string   `json:"short_name"`
+	Lat       *float32 `json:"lat,omitempty"`
+	Long      *float32 `json:"long,omitempty"`
+	Links     int      `json:"links"`
+}
+
+// Edge is From being heard by To
+type Edge struct {
+	From    uint32 `json:"from"`
+	FromHex string `json:"from_hex"`
+	To      uint32 `json:"to"`
+	ToHex   string `json:"to_hex"`
+	// Weight is every observation summed, each decayed by its age
+	Weight       float64 `json:"weight"`
+	Observations int     `json:"observations"`
+	// Snr is the latest known snr, SnrAvg the decay weighted mean; both nil if no observation carried one
+	Snr       *float32 `json:"snr,omitempty"`
+	SnrAvg    *float32 `json:"snr_avg,omitempty"`
+	LastHeard uint32   `json:"last_heard"`
+	Sources   []string `json:"sources"`
+
+	snrSeen   uint32
+	snrWeight float64
+	snrSum    float64
+}
+
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+type builder struct {
+	opts  Options
+	now   time.Time
+	edges map[[2]uint32]*Edge
+}
+
+func (b *builder) decay(at uint32) (float64, bool) {
+	age := b.now.Sub(time.Unix(int64(at), 0))
+	if b.opts.MaxAge > 0 && age > b.opts.MaxAge {
+		return 0, false
+	}
+	if age < 0 || b.opts.HalfLife <= 0 {
+		return 1, true
+	}
+	return math.Exp2(-age.Hours() / b.opts.HalfLife.Hours()), true
+}
+
+// observe adds one sighting of from being heard by to
+func (b *builder) observe(from uint32, to uint32, at uint32, snr *float32, source string) {
+	if from == to || from == broadcast || to == broadcast || from == 0 || to == 0 {
+		return
+	}
+	weight, ok := b.decay(at)
+	if !ok {
+		return
+	}
+	key := [2]uint32{from, to}
+	e, ok := b.edges[key]
+	if !ok {
+		e = &Edge{From: from, FromHex: keyring.FormatNodeId(from), To: to, ToHex: keyring.FormatNodeId(to), Sources: []string{}}
+		b.edges[key] = e
+	}
+	e.Weight += weight
+	e.Observations++
+	e.LastHeard = max(e.LastHeard, at)
+	if !slices.Contains(e.Sources, source) {
+		e.Sources = append(e.Sources, source)
+	}
+	if snr != nil {
+		if at >= e.snrSeen {
+			e.snrSeen = at
+			latest := *snr
+			e.Snr = &latest
+		}
+		e.snrWeight += weight
+		e.snrSum += weight * float64(*snr)
+	}
+}
+
+// hops walks a traceroute path, where snrs[i] is what path[i+1] heard path[i] at
+func (b *builder) hops(path []uint32, snrs []int32, at uint32) {
+	for i := 0; i+1 < len(path); i++ {
+		var snr *float32
+		if i < len(snrs) && snrs[i] != unknownSnr {
+			v := float32(snrs[i]) / 4
+			snr = &v
+		}
+		b.observe(path[i], path[i+1], at, snr, SourceTraceroute)
+	}
+}
+
+// traceroute adds the hops of one traceroute packet. A reply, from the destination to the requester,
+// carries the whole path towards and as much of the way back as it has travelled; a request only the hops so far
+func (b *builder) traceroute(from uint32, to uint32, route *meshtastic.RouteDiscovery, at uint32) {
+	reply := len(route.SnrTowards) > len(route.Route) || len(route.RouteBack) > 0 || len(route.SnrBack) > 0
+	if !reply {
+		b.hops(append([]uint32{from}, route.Route...), route.SnrTowards, at)
+		return
+	}
+	towards := append(append([]uint32{to}, route.Route...), from)
+	b.hops(towards, route.SnrTowards, at)
+	back := append([]uint32{from}, route.RouteBack...)
+	if len(route.SnrBack) > len(route.RouteBack) {
+		back = append(back, to)
+	}
+	b.hops(back, route.SnrBack, at)
+}
+
+// Build merges NeighborInfo reports and traceroute hops into one link graph
+func Build(st *state.State, now time.Time, opts Options) Graph {
+	b := &builder{opts: opts, now: now, edges: map[[2]uint32]*Edge{}}
+	neighbors := st.Neighbors.All()
+	for i := range neighbors {
+		m := &neighbors[i]
+		reporter := m.Underlying.NodeId
+		if reporter == 0 {
+			reporter = m.From
+		}
+		for _, n := range m.Underlying.Neighbors {
+			snr := n.Snr
+			b.observe(n.NodeId, reporter, m.RxTime, &snr, SourceNeighborInfo)
+		}
+	}
+	traceroutes := st.Traceroutes.All()
+	for i := range traceroutes {
+		m := &traceroutes[i]
+		b.traceroute(m.From, m.To, &m.Underlying, m.RxTime)
+	}
+
+	g := Graph{Nodes: []Node{}, Edges: make([]Edge, 0, len(b.edges))}
+	links := map[uint32]int{}
+	for _, e := range b.edges {
+		if e.snrWeight > 0 {
+			avg := float32(e.snrSum / e.snrWeight)
+			e.SnrAvg = &avg
+		}
+		links[e.From]++
+		links[e.To]++
+		g.Edges = append(g.Edges, *e)
+	}
+	slices.SortFunc(g.Edges, func(a, b Edge) int {
+		return cmp.Or(cmp.Compare(b.Weight, a.Weight), cmp.Compare(a.From, b.From), cmp.Compare(a.To, b.To))
+	})
+
+	for id, count := range links {
+		node := Node{Id: id, IdHex: keyring.FormatNodeId(id), Links: count}
+		if user := st.Users.LastBy(fmt.Sprintf("%d", id)); user != nil {
+			node.LongName = user.Underlying.LongName
+			node.ShortName = user.Underlying.ShortName
+		}
+		if pos := st.Positions.LastBy(fmt.Sprintf("%d", id)); pos != nil && pos.Underlying.LatitudeI != nil && pos.Underlying.LongitudeI != nil {
+			lat := float32(*pos.Underlying.LatitudeI) * 1e-7
+			long := float32(*pos.Underlying.LongitudeI) * 1e-7
+			node.Lat = &lat
+			node.Long = &long
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+	slices.SortFunc(g.Nodes, func(a, b Node) int {
+		return cmp.Or(cmp.Compare(b.Links, a.Links), cmp.Compare(a.Id, b.Id))
+	})
+	return g
+}
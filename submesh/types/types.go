@@ -9,6 +9,7 @@ type ParsedMessage[T any] struct {
 	To           uint32
 	Id           uint32
 	RxSnr        float32
+	RxRssi       int32
 	HopLimit     uint32
 	WantAck      bool
 	Priority     meshtastic.MeshPacket_Priority
@@ -16,12 +17,64 @@ type ParsedMessage[T any] struct {
 	PublicKey    []byte
 	PkiEncrypted bool
 	Channel      uint32
+	ChannelName  string
+	GatewayId    string
 }
 
 type MessageSummary struct {
-	PortNum   uint32
-	PortName  string
-	Length    int
-	Encrypted int
-	Summary   string
+	PortNum   uint32 `json:"port_num"`
+	PortName  string `json:"port_name"`
+	Length    int    `json:"length"`
+	Encrypted int    `json:"encrypted"`
+	Summary   string `json:"summary"`
+}
+
+// Reception is one gateway hearing a packet
+type Reception struct {
+	GatewayId string
+	ChannelId string
+	Topic     string
+	RxTime    uint32
+	RxRssi    int32
+	RxSnr     float32
+	HopLimit  uint32
+	HopStart  uint32
+}
+
+func (r Reception) HopsAway() uint32 {
+	if r.HopStart < r.HopLimit {
+		return 0
+	}
+	return r.HopStart - r.HopLimit
+}
+
+// PacketReceptions is one logical packet and every gateway that relayed it to us
+type PacketReceptions struct {
+	From       uint32
+	To         uint32
+	Id         uint32
+	FirstSeen  uint32
+	Receptions []Reception
+}
+
+// Rewrap copies the packet metadata of m around a different Underlying value
+func Rewrap[T any, U any](m *ParsedMessage[T], u U) ParsedMessage[U] {
+	return ParsedMessage[U]{
+		Underlying:   u,
+		RxTime:       m.RxTime,
+		From:         m.From,
+		To:           m.To,
+		Id:           m.Id,
+		RxSnr:        m.RxSnr,
+		RxRssi:       m.RxRssi,
+		HopLimit:     m.HopLimit,
+		WantAck:      m.WantAck,
+		Priority:     m.Priority,
+		HopStart:     m.HopStart,
+		PublicKey:    m.PublicKey,
+		PkiEncrypted: m.PkiEncrypted,
+		Channel:      m.Channel,
+		ChannelName:  m.ChannelName,
+		GatewayId:    m.GatewayId,
+	}
 }
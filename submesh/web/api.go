@@ -0,0 +1,370 @@
+package web
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/feeds"
+	"submesh/submesh/keyring"
+	"submesh/submesh/state"
+	"submesh/submesh/topology"
+	"submesh/submesh/types"
+	"time"
+
+	"buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const broadcastId = 4294967295
+
+// APIMessage is how every collection item is rendered in the JSON API
+type APIMessage struct {
+	RxTime       uint32          `json:"rx_time"`
+	Id           uint32          `json:"id"`
+	From         uint32          `json:"from"`
+	FromHex      string          `json:"from_hex"`
+	To           uint32          `json:"to"`
+	ToHex        string          `json:"to_hex"`
+	Channel      uint32          `json:"channel"`
+	ChannelName  string          `json:"channel_name,omitempty"`
+	GatewayId    string          `json:"gateway_id,omitempty"`
+	RxSnr        float32         `json:"rx_snr"`
+	RxRssi       int32           `json:"rx_rssi"`
+	HopLimit     uint32          `json:"hop_limit"`
+	HopStart     uint32          `json:"hop_start"`
+	WantAck      bool            `json:"want_ack"`
+	Priority     string          `json:"priority"`
+	PkiEncrypted bool            `json:"pki_encrypted"`
+	Data         json.RawMessage `json:"data"`
+}
+
+type APIList struct {
+	Count int          `json:"count"`
+	Items []APIMessage `json:"items"`
+	// Next and Prev are cursors for the older and newer pages, passed back as before and after
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+type APINode struct {
+	Id        uint32 `json:"id"`
+	IdHex     string `json:"id_hex"`
+	LongName  string `json:"long_name"`
+	ShortName string `json:"short_name"`
+	HwModel   string `json:"hw_model"`
+	Role      string `json:"role"`
+	RxTime    uint32 `json:"rx_time"`
+}
+
+type APINodeDetail struct {
+	Node         *APINode     `json:"node"`
+	Position     *APIMessage  `json:"position"`
+	Telemetry    *APIMessage  `json:"telemetry"`
+	TelemetryLog []APIMessage `json:"telemetry_history"`
+	MessagesFrom []APIMessage `json:"messages_from"`
+	MessagesTo   []APIMessage `json:"messages_to"`
+}
+
+var apiProtoJSON = protojson.MarshalOptions{UseProtoNames: true}
+
+func toAPIMessage[T any](m *types.ParsedMessage[T]) APIMessage {
+	var data []byte
+	if pm, ok := any(&m.Underlying).(proto.Message); ok {
+		data, _ = apiProtoJSON.Marshal(pm)
+	} else {
+		data, _ = json.Marshal(m.Underlying)
+	}
+	return APIMessage{
+		RxTime:       m.RxTime,
+		Id:           m.Id,
+		From:         m.From,
+		FromHex:      keyring.FormatNodeId(m.From),
+		To:           m.To,
+		ToHex:        keyring.FormatNodeId(m.To),
+		Channel:      m.Channel,
+		ChannelName:  m.ChannelName,
+		GatewayId:    m.GatewayId,
+		RxSnr:        m.RxSnr,
+		RxRssi:       m.RxRssi,
+		HopLimit:     m.HopLimit,
+		HopStart:     m.HopStart,
+		WantAck:      m.WantAck,
+		Priority:     m.Priority.String(),
+		PkiEncrypted: m.PkiEncrypted,
+		Data:         data,
+	}
+}
+
+func toAPIMessages[T any](ms []types.ParsedMessage[T]) []APIMessage {
+	out := make([]APIMessage, 0, len(ms))
+	for i := range ms {
+		out = append(out, toAPIMessage(&ms[i]))
+	}
+	return out
+}
+
+func toAPINode(u *types.ParsedMessage[meshtastic.User]) *APINode {
+	id := hexCodeToId(u.Underlying.Id)
+	if id == 0 {
+		id = u.From
+	}
+	return &APINode{
+		Id:        id,
+		IdHex:     keyring.FormatNodeId(id),
+		LongName:  u.Underlying.LongName,
+		ShortName: u.Underlying.ShortName,
+		HwModel:   u.Underlying.HwModel.String(),
+		Role:      u.Underlying.Role.String(),
+		RxTime:    u.RxTime,
+	}
+}
+
+// parseTime accepts unix seconds, RFC3339, or the local date and time an html form sends
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// apiWindow reads the since, until and limit query parameters shared by every list endpoint; limit is clamped to web.api.max_limit
+func apiWindow(c *gin.Context) (time.Time, time.Time, int, error) {
+	since := time.Unix(0, 0)
+	until := time.Unix(math.MaxUint32, 0)
+	limit := viper.GetInt("submesh.all_limit")
+	var err error
+	if s := c.Query("since"); s != "" {
+		if since, err = parseTime(s); err != nil {
+			return since, until, limit, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if s := c.Query("until"); s != "" {
+		if until, err = parseTime(s); err != nil {
+			return since, until, limit, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return since, until, limit, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+	// no limit still stops at the maximum, so one request can't serialize a whole store
+	if maxLimit := viper.GetInt("web.api.max_limit"); maxLimit > 0 && (limit == 0 || limit > maxLimit) {
+		limit = maxLimit
+	}
+	return since, until, limit, nil
+}
+
+// apiPageQuery reads the before and after cursors; a bare until starts paging from there
+func apiPageQuery(c *gin.Context, until time.Time, limit int) (state.PageQuery, error) {
+	q := state.PageQuery{Limit: limit}
+	if s := c.Query("before"); s != "" {
+		before, err := state.ParseCursor(s)
+		if err != nil {
+			return q, err
+		}
+		q.Before = &before
+	} else if s := c.Query("after"); s != "" {
+		after, err := state.ParseCursor(s)
+		if err != nil {
+			return q, err
+		}
+		q.After = &after
+	} else if c.Query("until") != "" {
+		q.Before = &state.Cursor{RxTime: uint32(until.Unix())}
+	}
+	return q, nil
+}
+
+// windowPage trims a page to [since, until), dropping the links that would only lead outside it
+func windowPage[T any](page state.Page[T], since time.Time, until time.Time) state.Page[T] {
+	items := page.Items[:0]
+	for _, m := range page.Items {
+		switch {
+		case int64(m.RxTime) < since.Unix():
+			page.Next = nil
+		case int64(m.RxTime) >= until.Unix():
+			page.Prev = nil
+		default:
+			items = append(items, m)
+		}
+	}
+	page.Items = items
+	return page
+}
+
+func cursorString(c *state.Cursor) string {
+	if c == nil {
+		return ""
+	}
+	return c.String()
+}
+
+func apiError(c *gin.Context, code int, err error) {
+	c.JSON(code, gin.H{"error": err.Error()})
+}
+
+// inWindow filters already fetched items to the requested time range
+func inWindow[T any](ms []types.ParsedMessage[T], since time.Time, until time.Time) []types.ParsedMessage[T] {
+	out := ms[:0]
+	for _, m := range ms {
+		if int64(m.RxTime) >= since.Unix() && int64(m.RxTime) < until.Unix() {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func listHandler[T any](collection func(*state.State) *state.HistoricalWithLastByPK[T]) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		since, until, limit, err := apiWindow(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		q, err := apiPageQuery(c, until, limit)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		page := windowPage(collection(sdb).Page(q), since, until)
+		if q.After == nil && c.Query("before") == "" {
+			// the first page of a window has nothing newer inside it
+			page.Prev = nil
+		}
+		items := toAPIMessages(page.Items)
+		c.JSON(http.StatusOK, APIList{Count: len(items), Items: items, Next: cursorString(page.Next), Prev: cursorString(page.Prev)})
+	}
+}
+
+func registerAPI(ctx context.Context, router *gin.Engine) {
+	api := router.Group("/api/v1")
+
+	api.GET("/stream", streamHandler())
+
+	api.GET("/feeds", func(c *gin.Context) {
+		all := ctx.Value(contextkeys.Feeds).(*feeds.Feeds)
+		items := []gin.H{}
+		if merged := all.Merged(); merged != nil {
+			items = append(items, gin.H{"name": merged.Name, "merged": true, "topics": []string{}})
+		}
+		for _, feed := range all.List() {
+			items = append(items, gin.H{"name": feed.Name, "merged": false, "topics": feed.Topics})
+		}
+		c.JSON(http.StatusOK, gin.H{"count": len(items), "default": all.Default().Name, "items": items})
+	})
+
+	api.GET("/brokers", func(c *gin.Context) {
+		items := brokerStatuses(ctx)
+		c.JSON(http.StatusOK, gin.H{"count": len(items), "items": items})
+	})
+
+	api.GET("/alerts", func(c *gin.Context) {
+		items := alertHistory(ctx)
+		c.JSON(http.StatusOK, gin.H{"count": len(items), "items": items})
+	})
+
+	api.GET("/topology", func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		c.JSON(http.StatusOK, topology.Build(sdb, time.Now(), topologyOptions()))
+	})
+
+	api.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", openAPIDocument)
+	})
+
+	api.GET("/nodes", func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		since, until, limit, err := apiWindow(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		q, err := apiPageQuery(c, until, limit)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		// the window applies to when each node's latest info arrived
+		users := state.PageOf(inWindow(sdb.Users.OnlyMostRecentByUnderlyingPropertyString("Id"), since, until), q)
+		nodes := make([]*APINode, 0, len(users.Items))
+		for i := range users.Items {
+			nodes = append(nodes, toAPINode(&users.Items[i]))
+		}
+		resp := gin.H{"count": len(nodes), "items": nodes}
+		if users.Next != nil {
+			resp["next"] = users.Next.String()
+		}
+		if users.Prev != nil {
+			resp["prev"] = users.Prev.String()
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	api.GET("/nodes/:id", func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		id, err := keyring.ParseNodeId(c.Param("id"))
+		if err != nil {
+			apiError(c, http.StatusBadRequest, fmt.Errorf("invalid node id: %w", err))
+			return
+		}
+		since, until, limit, err := apiWindow(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		pk := fmt.Sprintf("%d", id)
+
+		detail := APINodeDetail{
+			TelemetryLog: toAPIMessages(inWindow(sdb.Telemetry.ByFrom(id, 0), since, until)),
+			MessagesFrom: toAPIMessages(inWindow(sdb.AllMessages.ByFrom(id, 0), since, until)),
+			MessagesTo:   toAPIMessages(inWindow(sdb.AllMessages.ByTo(id, 0), since, until)),
+		}
+		if limit > 0 {
+			detail.TelemetryLog = detail.TelemetryLog[:min(limit, len(detail.TelemetryLog))]
+			detail.MessagesFrom = detail.MessagesFrom[:min(limit, len(detail.MessagesFrom))]
+			detail.MessagesTo = detail.MessagesTo[:min(limit, len(detail.MessagesTo))]
+		}
+		if user := sdb.Users.LastBy(pk); user != nil {
+			detail.Node = toAPINode(user)
+		}
+		if position := sdb.Positions.LastBy(pk); position != nil {
+			m := toAPIMessage(position)
+			detail.Position = &m
+		}
+		if telemetry := sdb.Telemetry.LastBy(pk); telemetry != nil {
+			m := toAPIMessage(telemetry)
+			detail.Telemetry = &m
+		}
+		if detail.Node == nil && detail.Position == nil && detail.Telemetry == nil && len(detail.MessagesFrom) == 0 && len(detail.MessagesTo) == 0 {
+			apiError(c, http.StatusNotFound, fmt.Errorf("node %s not heard", keyring.FormatNodeId(id)))
+			return
+		}
+		c.JSON(http.StatusOK, detail)
+	})
+
+	api.GET("/chats", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[string] { return &s.Chats }))
+	api.GET("/neighbors", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[meshtastic.NeighborInfo] { return &s.Neighbors }))
+	api.GET("/traceroutes", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[meshtastic.RouteDiscovery] { return &s.Traceroutes }))
+	api.GET("/telemetry", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[meshtastic.Telemetry] { return &s.Telemetry }))
+	api.GET("/positions", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[meshtastic.Position] { return &s.Positions }))
+	api.GET("/nondecryptable", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[int] { return &s.NonDecryptable }))
+	api.GET("/messages", listHandler(func(s *state.State) *state.HistoricalWithLastByPK[types.MessageSummary] { return &s.AllMessages }))
+}
@@ -0,0 +1,37 @@
+#!/bin/sh
+# Vendors leaflet into static/leaflet so maps work without internet; run through go generate.
+# The npm tarball is checked against the integrity npm publishes for it, which covers the images too,
+# then leaflet.js and leaflet.css against the same hashes the header pins for the CDN.
+set -eu
+
+version=1.9.4
+tarball=https://registry.npmjs.org/leaflet/-/leaflet-$version.tgz
+integrity=nxS1ynzJOmOlHp+iL3FyWqK89GtNL8U8rvlMOsQdTTssxZwCXh8N2NB3GDQOL+YR3XnWyZAxwQixURb+FA74PA==
+dest=static/leaflet
+
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+curl -fsSL -o "$tmp/leaflet.tgz" "$tarball"
+got=$(openssl dgst -sha512 -binary "$tmp/leaflet.tgz" | openssl base64 -A)
+if [ "$got" != "$integrity" ]; then
+	echo "leaflet-$version.tgz: sha512 $got, expected $integrity" >&2
+	exit 1
+fi
+tar -xzf "$tmp/leaflet.tgz" -C "$tmp"
+
+rm -rf "$dest"
+mkdir -p "$dest/images"
+for f in leaflet.js leaflet.css images/layers.png images/layers-2x.png images/marker-icon.png images/marker-icon-2x.png images/marker-shadow.png; do
+	cp "$tmp/package/dist/$f" "$dest/$f"
+done
+
+check() {
+	got=$(openssl dgst -sha256 -binary "$dest/$1" | openssl base64 -A)
+	if [ "$got" != "$2" ]; then
+		echo "$1: sha256 $got, expected $2" >&2
+		rm -rf "$dest"
+		exit 1
+	fi
+}
+check leaflet.js 20nQCchB9co0qIjJZRGuk2/Z9VM+kNiyxNV1lvTlZBo=
+check leaflet.css p4NxAoJBhIIN+hmNHrzRCf9tD/miZyoHS5obTRR9BMY=
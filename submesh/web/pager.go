@@ -0,0 +1,62 @@
+package web
+
+import (
+	"strconv"
+	"submesh/submesh/state"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+// Pager holds the links rendered by the "pager" template; empty links are not shown
+type Pager struct {
+	Newest string
+	Prev   string
+	Next   string
+}
+
+// pageQuery reads the before, after and size parameters; the prefix lets one page carry several lists
+func pageQuery(c *gin.Context, prefix string, defaultSize int) state.PageQuery {
+	q := state.PageQuery{Limit: defaultSize}
+	if size, err := strconv.Atoi(c.Query(prefix + "size")); err == nil && size > 0 {
+		q.Limit = size
+	}
+	if before, err := state.ParseCursor(c.Query(prefix + "before")); err == nil {
+		q.Before = &before
+	} else if after, err := state.ParseCursor(c.Query(prefix + "after")); err == nil {
+		q.After = &after
+	}
+	return q
+}
+
+func defaultPageQuery(c *gin.Context, prefix string) state.PageQuery {
+	return pageQuery(c, prefix, viper.GetInt("submesh.all_limit"))
+}
+
+// pagerFor builds the links for a page, keeping every other query parameter as it was
+func pagerFor[T any](c *gin.Context, prefix string, page state.Page[T]) Pager {
+	link := func(key string, cursor *state.Cursor) string {
+		values := c.Request.URL.Query()
+		values.Del(prefix + "before")
+		values.Del(prefix + "after")
+		if cursor != nil {
+			values.Set(prefix+key, cursor.String())
+		}
+		if len(values) == 0 {
+			return c.Request.URL.Path
+		}
+		return c.Request.URL.Path + "?" + values.Encode()
+	}
+
+	var pager Pager
+	if c.Query(prefix+"before") != "" || c.Query(prefix+"after") != "" {
+		pager.Newest = link("", nil)
+	}
+	if page.Prev != nil {
+		pager.Prev = link("after", page.Prev)
+	}
+	if page.Next != nil {
+		pager.Next = link("before", page.Next)
+	}
+	return pager
+}
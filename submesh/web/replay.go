@@ -0,0 +1,144 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/feeds"
+	"submesh/submesh/fileencoding"
+	"submesh/submesh/filelog"
+	"submesh/submesh/parser"
+	"submesh/submesh/state"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+var errReplayFull = errors.New("replay window holds too many entries")
+
+// replayWindowQuery reads since, which is required, and until, which defaults to an hour later
+func replayWindowQuery(c *gin.Context) (time.Time, time.Time, error) {
+	if c.Query("since") == "" {
+		return time.Time{}, time.Time{}, errors.New("since is required")
+	}
+	since, err := parseTime(c.Query("since"))
+	if err != nil {
+		return since, since, fmt.Errorf("invalid since: %w", err)
+	}
+	until := since.Add(time.Hour)
+	if s := c.Query("until"); s != "" {
+		if until, err = parseTime(s); err != nil {
+			return since, until, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if !until.After(since) {
+		return since, until, errors.New("until must be after since")
+	}
+	if max := viper.GetDuration("web.replay.max_window"); until.Sub(since) > max {
+		return since, until, fmt.Errorf("window is longer than %s", max)
+	}
+	return since, until, nil
+}
+
+// replayLogs are the file logs behind a feed; the merged feed has none of its own and reads every other feed's
+func replayLogs(feed *feeds.Feed, all *feeds.Feeds) []string {
+	if fl, ok := feed.Ctx.Value(contextkeys.RAWFileLogger).(*filelog.FileLog); ok {
+		return []string{fl.Filename()}
+	}
+	names := []string{}
+	for _, f := range all.List() {
+		if fl, ok := f.Ctx.Value(contextkeys.RAWFileLogger).(*filelog.FileLog); ok {
+			names = append(names, fl.Filename())
+		}
+	}
+	return names
+}
+
+// replay parses what a feed captured between since and until into a state of its own, leaving the feed's untouched
+func replay(ctx context.Context, feed *feeds.Feed, since time.Time, until time.Time) (*state.State, error) {
+	maxEntries := viper.GetInt("web.replay.max_entries")
+	entries := []fileencoding.LogEntry{}
+	for _, name := range replayLogs(feed, ctx.Value(contextkeys.Feeds).(*feeds.Feeds)) {
+		err := filelog.ReadRange(name, since, until, func(entry *fileencoding.LogEntry) error {
+			if len(entries) >= maxEntries {
+				return errReplayFull
+			}
+			entries = append(entries, *entry)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.SortStableFunc(entries, func(a, b fileencoding.LogEntry) int {
+		return a.TimeCaptured.Compare(b.TimeCaptured)
+	})
+
+	st := state.NewState()
+	scratch := context.WithValue(context.Background(), contextkeys.Logger, zap.NewNop())
+	scratch = context.WithValue(scratch, contextkeys.State, st)
+	scratch = context.WithValue(scratch, contextkeys.Keyring, feed.Ctx.Value(contextkeys.Keyring))
+	for _, entry := range entries {
+		parser.HandlePayload(scratch, entry.TimeCaptured, entry.Topic, entry.Packet, true)
+	}
+	return st, nil
+}
+
+func registerReplay(ctx context.Context, router *gin.Engine) {
+	router.GET("/api/v1/replay", func(c *gin.Context) {
+		since, until, err := replayWindowQuery(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		_, _, limit, err := apiWindow(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		q := pageQuery(c, "", limit)
+		st, err := replay(ctx, c.MustGet("feed").(*feeds.Feed), since, until)
+		if errors.Is(err, errReplayFull) {
+			apiError(c, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			apiError(c, http.StatusInternalServerError, err)
+			return
+		}
+		page := st.AllMessages.Page(q)
+		items := toAPIMessages(page.Items)
+		c.JSON(http.StatusOK, APIList{Count: len(items), Items: items, Next: cursorString(page.Next), Prev: cursorString(page.Prev)})
+	})
+
+	router.GET("/replay", func(c *gin.Context) {
+		data := gin.H{
+			"Since":     c.Query("since"),
+			"Until":     c.Query("until"),
+			"MaxWindow": viper.GetDuration("web.replay.max_window"),
+		}
+		if c.Query("since") != "" || c.Query("until") != "" {
+			since, until, err := replayWindowQuery(c)
+			var st *state.State
+			if err == nil {
+				st, err = replay(ctx, c.MustGet("feed").(*feeds.Feed), since, until)
+			}
+			if err != nil {
+				data["Error"] = err
+			} else {
+				page := st.AllMessages.Page(defaultPageQuery(c, ""))
+				data["Replayed"] = true
+				// links and reception counts come from what was replayed
+				data["State"] = st
+				data["All"] = page.Items
+				data["Pager"] = pagerFor(c, "", page)
+			}
+		}
+		c.HTML(http.StatusOK, "templates/replay.html", data)
+	})
+}
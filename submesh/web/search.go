@@ -0,0 +1,124 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/keyring"
+	"submesh/submesh/search"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+type APISearchResult struct {
+	Kind        search.Kind `json:"kind"`
+	Score       float64     `json:"score"`
+	RxTime      uint32      `json:"rx_time"`
+	Id          uint32      `json:"id"`
+	From        uint32      `json:"from"`
+	FromHex     string      `json:"from_hex"`
+	To          uint32      `json:"to"`
+	ToHex       string      `json:"to_hex"`
+	ChannelName string      `json:"channel_name,omitempty"`
+	PortName    string      `json:"port_name"`
+	Text        string      `json:"text"`
+	Snippet     string      `json:"snippet"`
+}
+
+// searchQuery reads q, kind, node, since, until and limit
+func searchQuery(c *gin.Context) (search.Query, error) {
+	q := search.Query{
+		Text:  c.Query("q"),
+		Limit: viper.GetInt("submesh.all_limit"),
+	}
+	for _, kind := range splitQuery(c, "kind") {
+		switch k := search.Kind(kind); k {
+		case search.KindChat, search.KindNode, search.KindMessage:
+			q.Kinds = append(q.Kinds, k)
+		default:
+			return q, fmt.Errorf("unknown kind %q", kind)
+		}
+	}
+	if s := c.Query("node"); s != "" {
+		node, err := keyring.ParseNodeId(s)
+		if err != nil {
+			return q, fmt.Errorf("invalid node %q", s)
+		}
+		q.Node = node
+	}
+	var err error
+	if s := c.Query("since"); s != "" {
+		if q.Since, err = parseTime(s); err != nil {
+			return q, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if s := c.Query("until"); s != "" {
+		if q.Until, err = parseTime(s); err != nil {
+			return q, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: %s", s)
+		}
+	}
+	return q, nil
+}
+
+func registerSearch(router *gin.Engine) {
+	router.GET("/api/v1/search", func(c *gin.Context) {
+		index, _ := feedCtx(c).Value(contextkeys.Search).(*search.Index)
+		q, err := searchQuery(c)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+		results, total := index.Search(q)
+		items := make([]APISearchResult, 0, len(results))
+		for _, r := range results {
+			items = append(items, APISearchResult{
+				Kind:        r.Kind,
+				Score:       r.Score,
+				RxTime:      r.RxTime,
+				Id:          r.Id,
+				From:        r.From,
+				FromHex:     keyring.FormatNodeId(r.From),
+				To:          r.To,
+				ToHex:       keyring.FormatNodeId(r.To),
+				ChannelName: r.ChannelName,
+				PortName:    r.PortName,
+				Text:        r.Text,
+				Snippet:     r.Snippet,
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"count": len(items), "total": total, "items": items})
+	})
+
+	router.GET("/search", func(c *gin.Context) {
+		index, _ := feedCtx(c).Value(contextkeys.Search).(*search.Index)
+		q, err := searchQuery(c)
+		var results []search.Result
+		total := 0
+		searched := false
+		for _, param := range []string{"q", "kind", "node", "since", "until"} {
+			searched = searched || c.Query(param) != ""
+		}
+		if err == nil && searched {
+			results, total = index.Search(q)
+		}
+		c.HTML(http.StatusOK, "templates/search.html", gin.H{
+			"State":    c.MustGet("statedb"),
+			"Query":    c.Query("q"),
+			"Kind":     c.Query("kind"),
+			"Node":     c.Query("node"),
+			"Since":    c.Query("since"),
+			"Until":    c.Query("until"),
+			"Error":    err,
+			"Searched": searched,
+			"Results":  results,
+			"Total":    total,
+		})
+	})
+}
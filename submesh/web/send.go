@@ -0,0 +1,158 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/downlink"
+	"submesh/submesh/keyring"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+type APISendRequest struct {
+	Channel string `json:"channel" form:"channel"`
+	// To is a node id, empty to broadcast
+	To   string `json:"to" form:"to"`
+	Text string `json:"text" form:"text"`
+}
+
+type APISent struct {
+	Id          uint32 `json:"id"`
+	From        uint32 `json:"from"`
+	FromHex     string `json:"from_hex"`
+	To          uint32 `json:"to"`
+	ToHex       string `json:"to_hex"`
+	ChannelName string `json:"channel_name"`
+	Topic       string `json:"topic"`
+}
+
+var (
+	errDownlinkDisabled = errors.New("downlink is not enabled")
+	errCrossOrigin      = errors.New("cross-origin request")
+	errUnauthorized     = errors.New("missing or wrong downlink token")
+	errCSRF             = errors.New("form expired, reload the page")
+)
+
+// csrfToken is put in the compose form and checked when it's posted. It lasts as long as the process,
+// which is enough since a page on another site can't read it
+var csrfToken = func() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}()
+
+// sameOrigin rejects requests a browser made on behalf of another site. Requests without Origin or Referer,
+// like curl's, pass
+func sameOrigin(r *http.Request) bool {
+	from := r.Header.Get("Origin")
+	if from == "" {
+		from = r.Header.Get("Referer")
+	}
+	if from == "" {
+		return true
+	}
+	u, err := url.Parse(from)
+	return err == nil && u.Host == r.Host
+}
+
+// authorized checks downlink.token, when one is set, against a bearer token or the form's token field
+func authorized(c *gin.Context) bool {
+	want := viper.GetString("downlink.token")
+	if want == "" {
+		return true
+	}
+	got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok {
+		got = c.PostForm("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// sendChannels are the channels the compose box offers; nil when sending is off
+func sendChannels(ctx context.Context, c *gin.Context) []string {
+	if _, ok := ctx.Value(contextkeys.Downlink).(*downlink.Sender); !ok {
+		return nil
+	}
+	names := []string{}
+	for _, ch := range feedCtx(c).Value(contextkeys.Keyring).(*keyring.Keyring).Channels() {
+		if ch.Key != nil {
+			names = append(names, ch.Name)
+		}
+	}
+	return names
+}
+
+// send reads the request from json or a form and hands it to the sender, returning the status to answer with
+func send(ctx context.Context, c *gin.Context) (*downlink.Sent, int, error) {
+	sender, ok := ctx.Value(contextkeys.Downlink).(*downlink.Sender)
+	if !ok {
+		return nil, http.StatusNotFound, errDownlinkDisabled
+	}
+	if !sameOrigin(c.Request) {
+		return nil, http.StatusForbidden, errCrossOrigin
+	}
+	if !authorized(c) {
+		return nil, http.StatusUnauthorized, errUnauthorized
+	}
+	var req APISendRequest
+	if err := c.ShouldBind(&req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	msg := downlink.Message{Channel: req.Channel, To: downlink.Broadcast, Text: req.Text}
+	if req.To != "" {
+		to, err := keyring.ParseNodeId(req.To)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid to %q", req.To)
+		}
+		msg.To = to
+	}
+	sent, err := sender.Send(c.Request.Context(), feedCtx(c).Value(contextkeys.Keyring).(*keyring.Keyring), msg)
+	if errors.Is(err, downlink.ErrInvalid) {
+		return nil, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	return sent, http.StatusCreated, nil
+}
+
+func registerSend(ctx context.Context, router *gin.Engine) {
+	router.POST("/api/v1/messages", func(c *gin.Context) {
+		sent, code, err := send(ctx, c)
+		if err != nil {
+			apiError(c, code, err)
+			return
+		}
+		c.JSON(code, APISent{
+			Id:          sent.Id,
+			From:        sent.From,
+			FromHex:     keyring.FormatNodeId(sent.From),
+			To:          sent.To,
+			ToHex:       keyring.FormatNodeId(sent.To),
+			ChannelName: sent.Channel,
+			Topic:       sent.Topic,
+		})
+	})
+
+	// the compose box on /chats
+	router.POST("/chats", func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.PostForm("csrf")), []byte(csrfToken)) != 1 {
+			c.String(http.StatusForbidden, errCSRF.Error())
+			return
+		}
+		target := "/chats"
+		if _, _, err := send(ctx, c); err != nil {
+			target += "?send_error=" + url.QueryEscape(err.Error())
+		}
+		c.Redirect(http.StatusSeeOther, target)
+	})
+}
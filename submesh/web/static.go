@@ -6,6 +6,8 @@ import (
 	"path"
 )
 
+//go:generate sh fetch_leaflet.sh
+
 //go:embed static/*
 var staticFSRoot embed.FS
 
@@ -0,0 +1,88 @@
+// Live row appending for tables marked with data-live="<stream query>".
+// Rows come from /api/v1/stream over Server-Sent Events while the "Live" box is ticked.
+(function () {
+  const BROADCAST = 4294967295;
+
+  function cell(row, content, code) {
+    const td = row.insertCell();
+    if (code) {
+      const c = document.createElement("code");
+      c.textContent = content;
+      td.appendChild(c);
+    } else {
+      td.textContent = content;
+    }
+    return td;
+  }
+
+  function userCell(row, id, hex) {
+    const td = row.insertCell();
+    const center = document.createElement("center");
+    if (id === BROADCAST) {
+      center.textContent = "All";
+    } else {
+      const a = document.createElement("a");
+      a.href = "/user?id=" + id;
+      const icon = document.createElement("minidenticon-svg");
+      icon.setAttribute("username", id);
+      a.appendChild(icon);
+      a.appendChild(document.createElement("br"));
+      a.appendChild(document.createTextNode(hex));
+      center.appendChild(a);
+    }
+    td.appendChild(center);
+  }
+
+  const columns = {
+    all: function (row, m) {
+      cell(row, "just now");
+      userCell(row, m.from, m.from_hex);
+      userCell(row, m.to, m.to_hex);
+      cell(row, m.rx_snr);
+      cell(row, m.hop_start + "/" + m.hop_limit);
+      cell(row, m.want_ack ? "✅" : "❌");
+      cell(row, m.priority);
+      cell(row, m.channel_name || "");
+      cell(row, m.data.port_name);
+      cell(row, m.data.length);
+      cell(row, m.data.encrypted === 1 ? "✅" : "❌");
+      cell(row, m.data.summary, true);
+      const td = row.insertCell();
+      const a = document.createElement("a");
+      a.href = "/packet?from=" + m.from + "&id=" + m.id;
+      a.textContent = "gateways";
+      td.appendChild(a);
+    },
+    chats: function (row, m) {
+      cell(row, "just now");
+      userCell(row, m.from, m.from_hex);
+      userCell(row, m.to, m.to_hex);
+      cell(row, m.channel_name || "");
+      cell(row, m.data.summary);
+    },
+  };
+
+  document.querySelectorAll("table[data-live]").forEach(function (table) {
+    const render = columns[table.dataset.liveColumns];
+    const toggle = document.getElementById(table.id + "-live");
+    if (!render || !toggle) {
+      return;
+    }
+    let source = null;
+    toggle.addEventListener("change", function () {
+      if (!toggle.checked) {
+        if (source) {
+          source.close();
+          source = null;
+        }
+        return;
+      }
+      source = new EventSource("/api/v1/stream?" + table.dataset.live);
+      source.addEventListener("message", function (e) {
+        const m = JSON.parse(e.data);
+        // row 0 is the header
+        render(table.insertRow(1), m);
+      });
+    });
+  });
+})();
@@ -0,0 +1,169 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/hub"
+	"submesh/submesh/keyring"
+	"time"
+
+	"buf.build/gen/go/meshtastic/protobufs/protocolbuffers/go/meshtastic"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const streamKeepalive = 30 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+func splitQuery(c *gin.Context, name string) []string {
+	var values []string
+	for _, v := range c.QueryArray(name) {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+// streamFilter reads portnum (number or name), node (decimal or !hex) and channel (hash or configured name)
+func streamFilter(c *gin.Context, keys *keyring.Keyring) (hub.Filter, error) {
+	var filter hub.Filter
+	for _, p := range splitQuery(c, "portnum") {
+		if n, err := strconv.ParseUint(p, 10, 32); err == nil {
+			filter.PortNums = append(filter.PortNums, uint32(n))
+		} else if n, ok := meshtastic.PortNum_value[strings.ToUpper(p)]; ok {
+			filter.PortNums = append(filter.PortNums, uint32(n))
+		} else {
+			return filter, fmt.Errorf("unknown portnum %q", p)
+		}
+	}
+	for _, n := range splitQuery(c, "node") {
+		id, err := keyring.ParseNodeId(n)
+		if err != nil {
+			return filter, fmt.Errorf("invalid node %q", n)
+		}
+		filter.Nodes = append(filter.Nodes, id)
+	}
+	for _, ch := range splitQuery(c, "channel") {
+		if n, err := strconv.ParseUint(ch, 10, 32); err == nil {
+			filter.Channels = append(filter.Channels, uint32(n))
+			continue
+		}
+		found := false
+		if keys != nil {
+			for _, key := range keys.Channels() {
+				if key.Name == ch {
+					filter.Channels = append(filter.Channels, key.Hash)
+					found = true
+				}
+			}
+		}
+		if !found {
+			return filter, fmt.Errorf("unknown channel %q", ch)
+		}
+	}
+	return filter, nil
+}
+
+func streamSSE(c *gin.Context, sub *hub.Subscription) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Header("Content-Type", "text/event-stream")
+	// send headers right away so clients see the stream open before the first packet
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case m, ok := <-sub.C():
+			if !ok {
+				return false
+			}
+			c.SSEvent("message", toAPIMessage(&m))
+			return true
+		case <-keepalive.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func streamWebSocket(c *gin.Context, sub *hub.Subscription) {
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// the client never sends anything we care about, but reading is how a close is noticed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case m, ok := <-sub.C():
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(toAPIMessage(&m)); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// streamHandler serves decoded packets live, as SSE or as a WebSocket when the client asks to upgrade
+func streamHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := feedCtx(c)
+		liveHub, ok := ctx.Value(contextkeys.Hub).(*hub.Hub)
+		if !ok {
+			apiError(c, http.StatusServiceUnavailable, fmt.Errorf("live stream not available"))
+			return
+		}
+		keys, _ := ctx.Value(contextkeys.Keyring).(*keyring.Keyring)
+		filter, err := streamFilter(c, keys)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		sub := liveHub.Subscribe(filter)
+		defer sub.Close()
+
+		if websocket.IsWebSocketUpgrade(c.Request) {
+			streamWebSocket(c, sub)
+			return
+		}
+		streamSSE(c, sub)
+	}
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"submesh/submesh/contextkeys"
+	"submesh/submesh/mbtiles"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+)
+
+const maxMapZoom = 19
+
+// localLeaflet is whether leaflet was vendored into the static files by go generate
+func localLeaflet() bool {
+	_, err := fs.Stat(staticFSRoot, "static/leaflet/leaflet.js")
+	return err == nil
+}
+
+// onlineTile fills a tile url template like https://tile.openstreetmap.org/{z}/{x}/{y}.png
+func onlineTile(z string, x string, y string) string {
+	return strings.NewReplacer("{z}", z, "{x}", x, "{y}", y, "{s}", "a").Replace(viper.GetString("web.map.online"))
+}
+
+// mapTiles is the leaflet tile layer every map page adds: the local tiles when web.map.mbtiles is set,
+// otherwise web.map.online, otherwise none
+func mapTiles(ctx context.Context) template.JS {
+	layer := gin.H{"url": viper.GetString("web.map.online")}
+	options := gin.H{"maxZoom": maxMapZoom, "attribution": viper.GetString("web.map.attribution")}
+	if tiles, ok := ctx.Value(contextkeys.Tiles).(*mbtiles.MBTiles); ok {
+		layer["url"] = "/tiles/{z}/{x}/{y}"
+		if tiles.Attribution != "" {
+			options["attribution"] = tiles.Attribution
+		}
+		if !viper.GetBool("web.map.online_fallback") {
+			// zoom past the file by scaling its deepest tiles up
+			options["maxNativeZoom"] = tiles.MaxZoom
+		}
+	}
+	layer["options"] = options
+	marshalled, _ := json.Marshal(layer)
+	return template.JS(marshalled)
+}
+
+func registerTiles(ctx context.Context, router *gin.Engine) {
+	tiles, ok := ctx.Value(contextkeys.Tiles).(*mbtiles.MBTiles)
+	if !ok {
+		return
+	}
+	router.GET("/tiles/:z/:x/:y", func(c *gin.Context) {
+		z, errZ := strconv.Atoi(c.Param("z"))
+		x, errX := strconv.Atoi(c.Param("x"))
+		y, errY := strconv.Atoi(strings.TrimSuffix(c.Param("y"), "."+tiles.Format))
+		if errZ != nil || errX != nil || errY != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		data, err := tiles.Tile(z, x, y)
+		if errors.Is(err, mbtiles.ErrNoTile) {
+			if viper.GetBool("web.map.online_fallback") && viper.GetString("web.map.online") != "" {
+				c.Redirect(http.StatusFound, onlineTile(c.Param("z"), c.Param("x"), strconv.Itoa(y)))
+				return
+			}
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.Header("Cache-Control", "public, max-age=86400")
+		c.Data(http.StatusOK, tiles.ContentType(), data)
+	})
+}
@@ -6,12 +6,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"slices"
 	"strconv"
 	"strings"
+	"submesh/submesh/alerts"
 	"submesh/submesh/contextkeys"
+	"submesh/submesh/feeds"
+	"submesh/submesh/metrics"
+	"submesh/submesh/mqtt"
 	"submesh/submesh/state"
+	"submesh/submesh/topology"
 	"submesh/submesh/types"
 	"time"
 
@@ -19,6 +25,7 @@ import (
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
 	"github.com/gomig/avatar"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 )
@@ -119,13 +126,60 @@ func hexCodeToId(hexCode string) uint32 {
 	return uint32(decimal_num)
 }
 
+const feedCookie = "submesh_feed"
+
+// ApiMiddleware picks the feed from the feed parameter, then the cookie the switcher leaves, then the default
 func ApiMiddleware(ctx context.Context) gin.HandlerFunc {
+	all := ctx.Value(contextkeys.Feeds).(*feeds.Feeds)
 	return func(c *gin.Context) {
-		c.Set("statedb", ctx.Value(contextkeys.State).(*state.State))
+		feed := all.Default()
+		if name := c.Query("feed"); name != "" {
+			if feed = all.Get(name); feed == nil {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown feed %q", name)})
+				return
+			}
+			c.SetCookie(feedCookie, name, 0, "/", "", false, false)
+		} else if name, err := c.Cookie(feedCookie); err == nil && all.Get(name) != nil {
+			feed = all.Get(name)
+		}
+		c.Set("feed", feed)
+		c.Set("statedb", feed.State)
 		c.Next()
 	}
 }
 
+// brokerStatuses snapshots every broker connection
+func brokerStatuses(ctx context.Context) []mqtt.BrokerStatus {
+	statuses, _ := ctx.Value(contextkeys.Brokers).([]*mqtt.Status)
+	snaps := make([]mqtt.BrokerStatus, 0, len(statuses))
+	for _, status := range statuses {
+		snaps = append(snaps, status.Snapshot())
+	}
+	return snaps
+}
+
+// alertHistory is the newest alerts first, empty when alerting is off
+func alertHistory(ctx context.Context) []alerts.Alert {
+	engine, ok := ctx.Value(contextkeys.Alerts).(*alerts.Engine)
+	if !ok {
+		return []alerts.Alert{}
+	}
+	return engine.History()
+}
+
+// topologyOptions decays links by web.topology.half_life and drops them after web.topology.max_age
+func topologyOptions() topology.Options {
+	return topology.Options{
+		HalfLife: viper.GetDuration("web.topology.half_life"),
+		MaxAge:   viper.GetDuration("web.topology.max_age"),
+	}
+}
+
+// feedCtx is the context of the feed the request is looking at
+func feedCtx(c *gin.Context) context.Context {
+	return c.MustGet("feed").(*feeds.Feed).Ctx
+}
+
 func coordToFloat(s int32) float32 {
 	return float32(s) * 1e-7
 }
@@ -143,7 +197,7 @@ type HeatMapData struct {
 }
 
 func lastHeard(state *state.State, id uint32) string {
-	userObj := state.AllMessages.LastByProperty("From", fmt.Sprintf("%d", id))
+	userObj := state.AllMessages.LastFrom(id)
 	if userObj != nil {
 		return timeAgo(&userObj.RxTime)
 	}
@@ -228,9 +282,8 @@ func StartServer(ctx context.Context) {
 			decimal_num, _ := strconv.ParseInt(s, 10, 64)
 			return uint32(decimal_num)
 		},
-		"idToShortaddr": func(id uint32) string {
-			return idToShortaddr(ctx.Value(contextkeys.State).(*state.State), id)
-		},
+		// these take the state the page was rendered from, which is the request's feed
+		"idToShortaddr": idToShortaddr,
 		"bytesToB64String": func(b []byte) string {
 			return base64.StdEncoding.EncodeToString(b)
 		},
@@ -288,21 +341,25 @@ func StartServer(ctx context.Context) {
 			}
 			return fmt.Sprintf("%s%s", s, unit)
 		},
-		"coordToFloat": coordToFloat,
-		"longNameFromId": func(id uint32) string {
-			return longNameFromId(ctx.Value(contextkeys.State).(*state.State), id)
-		},
+		"coordToFloat":   coordToFloat,
+		"longNameFromId": longNameFromId,
 		"unixToHourDate": func(t uint32) string {
 			return time.Unix(int64(t), 0).Format("2006-01-02 15:04 PM")
 		},
-		"lastHeard": func(id uint32) string {
-			return lastHeard(ctx.Value(contextkeys.State).(*state.State), id)
-		},
+		"lastHeard": lastHeard,
 		"timeAgoInt": func(id uint32) string {
 			return timeAgo(&id)
 		},
-		"lastAltitide": func(id uint32) string {
-			return lastAltitude(ctx.Value(contextkeys.State).(*state.State), id)
+		"lastAltitide": lastAltitude,
+		"feedNames": func() []string {
+			return ctx.Value(contextkeys.Feeds).(*feeds.Feeds).Names()
+		},
+		"receptionCount": func(st *state.State, from uint32, id uint32) int {
+			return st.Receptions.Count(from, id)
+		},
+		"localLeaflet": localLeaflet,
+		"mapTiles": func() template.JS {
+			return mapTiles(ctx)
 		},
 		"tracerouteTo": func(route *meshtastic.RouteDiscovery) []TwoRow {
 			ret := []TwoRow{}
@@ -334,11 +391,20 @@ func StartServer(ctx context.Context) {
 
 	router.Use(ginzap.RecoveryWithZap(logger, true))
 
+	registerAPI(ctx, router)
+	registerSearch(router)
+	registerSend(ctx, router)
+	registerTiles(ctx, router)
+	registerReplay(ctx, router)
+
 	router.GET("/", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
 
+		users := state.PageOf(sdb.Users.OnlyMostRecentByUnderlyingPropertyString("Id"), defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/users.html", gin.H{
-			"Users": sdb.Users.OnlyMostRecentByUnderlyingPropertyString("Id"),
+			"State": sdb,
+			"Users": users.Items,
+			"Pager": pagerFor(c, "", users),
 		})
 	})
 
@@ -352,80 +418,83 @@ func StartServer(ctx context.Context) {
 		var intId = uint32(decimal_num)
 		var position *types.ParsedMessage[meshtastic.Position]
 		var telemetry *types.ParsedMessage[meshtastic.Telemetry]
-		var allTelemetry []types.ParsedMessage[meshtastic.Telemetry]
 
 		if user != nil {
 			intId = hexCodeToId(user.Underlying.Id)
 		}
-		position = ctx.Value(contextkeys.State).(*state.State).Positions.LastBy(fmt.Sprintf("%d", intId))
-		telemetry = ctx.Value(contextkeys.State).(*state.State).Telemetry.LastBy(fmt.Sprintf("%d", intId))
-		allTelemetry = ctx.Value(contextkeys.State).(*state.State).Telemetry.FilteredByString("From", fmt.Sprintf("%d", intId))
-		slices.Reverse(allTelemetry)
+		position = sdb.Positions.LastBy(fmt.Sprintf("%d", intId))
+		telemetry = sdb.Telemetry.LastBy(fmt.Sprintf("%d", intId))
 		limitTo := viper.GetInt("submesh.all_limit")
-		from := sdb.AllMessages.FilteredByString("From", fmt.Sprintf("%d", intId))
-		if len(from) > limitTo {
-			from = from[:limitTo]
-		}
-		to := sdb.AllMessages.FilteredByString("To", fmt.Sprintf("%d", intId))
-		if len(to) > limitTo {
-			to = to[:limitTo]
-		}
-		metricsLimit := (limitTo * 2)
-		if len(allTelemetry) > metricsLimit {
-			allTelemetry = allTelemetry[:metricsLimit]
-		}
+		// charts read oldest first
+		allTelemetry := sdb.Telemetry.PageByFrom(intId, pageQuery(c, "telemetry_", limitTo*2))
+		slices.Reverse(allTelemetry.Items)
+		from := sdb.AllMessages.PageByFrom(intId, pageQuery(c, "from_", limitTo))
+		to := sdb.AllMessages.PageByTo(intId, pageQuery(c, "to_", limitTo))
 		c.HTML(http.StatusOK, "templates/user.html", gin.H{
-			"QueryUser":     id,
-			"User":          user,
-			"Position":      position,
-			"LastTelemetry": telemetry,
-			"Telemetry":     allTelemetry,
-			"intId":         intId,
-			"FromMsgs":      from,
-			"ToMsgs":        to,
+			"State":          sdb,
+			"QueryUser":      id,
+			"User":           user,
+			"Position":       position,
+			"LastTelemetry":  telemetry,
+			"Telemetry":      allTelemetry.Items,
+			"TelemetryPager": pagerFor(c, "telemetry_", allTelemetry),
+			"intId":          intId,
+			"FromMsgs":       from.Items,
+			"FromPager":      pagerFor(c, "from_", from),
+			"ToMsgs":         to.Items,
+			"ToPager":        pagerFor(c, "to_", to),
 		})
 	})
 
 	router.GET("/chats", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
+		chats := sdb.Chats.Page(defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/chats.html", gin.H{
-			"Chats": sdb.Chats.All(),
+			"State":     sdb,
+			"Chats":     chats.Items,
+			"Pager":     pagerFor(c, "", chats),
+			"Channels":  sendChannels(ctx, c),
+			"CSRF":      csrfToken,
+			"NeedToken": viper.GetString("downlink.token") != "",
+			"SendError": c.Query("send_error"),
 		})
 	})
 
 	router.GET("/neighbors", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
+		neighbors := state.PageOf(sdb.Neighbors.OnlyMostRecentByUnderlyingPropertyString("NodeId"), defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/neighbors.html", gin.H{
-			"Neighbors": sdb.Neighbors.OnlyMostRecentByUnderlyingPropertyString("NodeId"),
+			"State":     sdb,
+			"Neighbors": neighbors.Items,
+			"Pager":     pagerFor(c, "", neighbors),
 		})
 	})
 	router.GET("/telemetry", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
-		limit := viper.GetInt("submesh.all_limit")
-		telemetry := sdb.Telemetry.All()
-		if len(telemetry) > limit {
-			telemetry = telemetry[:limit]
-		}
+		telemetry := sdb.Telemetry.Page(defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/telemetry.html", gin.H{
-			"Telemetry": telemetry,
+			"State":     sdb,
+			"Telemetry": telemetry.Items,
+			"Pager":     pagerFor(c, "", telemetry),
 		})
 	})
 	router.GET("/traceroutes", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
-		limit := viper.GetInt("submesh.all_limit")
-		traceroutes := sdb.Traceroutes.All()
-		if len(traceroutes) > limit {
-			traceroutes = traceroutes[:limit]
-		}
+		traceroutes := sdb.Traceroutes.Page(defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/traceroutes.html", gin.H{
-			"Traceroutes": traceroutes,
+			"State":       sdb,
+			"Traceroutes": traceroutes.Items,
+			"Pager":       pagerFor(c, "", traceroutes),
 			"Heatmap":     tracerouteHeatmap(sdb),
 		})
 	})
 	router.GET("/nondecryptable", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
+		nonDecryptable := sdb.NonDecryptable.Page(defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/nondecryptable.html", gin.H{
-			"NonDecryptable": sdb.NonDecryptable.All(),
+			"State":          sdb,
+			"NonDecryptable": nonDecryptable.Items,
+			"Pager":          pagerFor(c, "", nonDecryptable),
 		})
 	})
 	router.GET("/map", func(c *gin.Context) {
@@ -435,18 +504,72 @@ func StartServer(ctx context.Context) {
 			"Heatmap":   heatmapMessageCount(sdb),
 		})
 	})
+	router.GET("/topology", func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		graph, _ := json.Marshal(topology.Build(sdb, time.Now(), topologyOptions()))
+		c.HTML(http.StatusOK, "templates/topology.html", gin.H{
+			"Graph": template.JS(graph),
+		})
+	})
 	router.GET("/all", func(c *gin.Context) {
 		sdb, _ := c.MustGet("statedb").(*state.State)
-		allm := sdb.AllMessages.All()
-		only := viper.GetInt("submesh.all_limit")
-		if len(allm) > only {
-			allm = allm[:only]
-		}
+		allm := sdb.AllMessages.Page(defaultPageQuery(c, ""))
 		c.HTML(http.StatusOK, "templates/all.html", gin.H{
-			"All": allm,
+			"State": sdb,
+			"All":   allm.Items,
+			"Pager": pagerFor(c, "", allm),
+		})
+	})
+
+	router.GET("/packet", func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		from, _ := strconv.ParseUint(c.Query("from"), 10, 32)
+		id, _ := strconv.ParseUint(c.Query("id"), 10, 32)
+		msgs := []types.ParsedMessage[types.MessageSummary]{}
+		for _, msg := range sdb.AllMessages.FilteredByString("Id", fmt.Sprintf("%d", id)) {
+			if msg.From == uint32(from) {
+				msgs = append(msgs, msg)
+			}
+		}
+		c.HTML(http.StatusOK, "templates/packet.html", gin.H{
+			"State":  sdb,
+			"Packet": sdb.Receptions.Get(uint32(from), uint32(id)),
+			"Msgs":   msgs,
+		})
+	})
+	router.GET("/gateways", func(c *gin.Context) {
+		sdb, _ := c.MustGet("statedb").(*state.State)
+		c.HTML(http.StatusOK, "templates/gateways.html", gin.H{
+			"State":    sdb,
+			"Coverage": sdb.Receptions.Coverage(),
+		})
+	})
+
+	if viper.GetBool("web.metrics") {
+		registry := ctx.Value(contextkeys.Metrics).(*metrics.Metrics).Registry
+		router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+	}
+
+	router.GET("/brokers", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "templates/brokers.html", gin.H{
+			"Brokers": brokerStatuses(ctx),
+		})
+	})
+
+	router.GET("/alerts", func(c *gin.Context) {
+		engine, enabled := ctx.Value(contextkeys.Alerts).(*alerts.Engine)
+		var rules []alerts.Rule
+		if enabled {
+			rules = engine.Rules()
+		}
+		c.HTML(http.StatusOK, "templates/alerts.html", gin.H{
+			"State":   c.MustGet("statedb"),
+			"Enabled": enabled,
+			"Rules":   rules,
+			"Alerts":  alertHistory(ctx),
 		})
 	})
 
-	router.Run(fmt.Sprintf(":%d", viper.GetInt("web.port")))
+	router.Run(net.JoinHostPort(viper.GetString("web.host"), strconv.Itoa(viper.GetInt("web.port"))))
 
 }